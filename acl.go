@@ -0,0 +1,151 @@
+package transproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClientACL allows or denies clients by the source address. Denied
+// addresses win over allowed ones. All clients are allowed if both are
+// empty, and only the allowed ones if the allowed list isn't empty.
+type ClientACL struct {
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewClientACL parses the lists of CIDRs or IP addresses.
+func NewClientACL(allow, deny []string) (*ClientACL, error) {
+	a := &ClientACL{}
+	var err error
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("Invalid allowed client: %s", err)
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("Invalid denied client: %s", err)
+	}
+	return a, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: Not an IP address or CIDR", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed returns whether the client of the IP address is allowed.
+func (a *ClientACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedAddr returns whether the client of the address is allowed, and logs
+// and counts the rejection by the listener.
+func (a *ClientACL) allowedAddr(addr net.Addr, category, listener string) bool {
+	if a == nil {
+		return true
+	}
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.UDPAddr:
+		ip = v.IP
+	}
+	if a.Allowed(ip) {
+		return true
+	}
+	clientRejections.With(listener).Inc()
+	log.Printf("warn: category='%s' remoteAddr='%s' Rejected the client by the ACL", category, addr)
+	return false
+}
+
+// Update replaces the lists by the other ones, which are used by the
+// following connections and queries.
+func (a *ClientACL) Update(other *ClientACL) {
+	other.lock.RLock()
+	allow, deny := other.allow, other.deny
+	other.lock.RUnlock()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.allow = allow
+	a.deny = deny
+}
+
+// aclListener is a net.Listener which closes connections from the clients
+// denied by the ACL on accept.
+type aclListener struct {
+	net.Listener
+	acl      *ClientACL
+	category string
+	port     string
+}
+
+func newACLListener(l net.Listener, acl *ClientACL, category string, port int) net.Listener {
+	if acl == nil {
+		return l
+	}
+	return &aclListener{
+		Listener: l,
+		acl:      acl,
+		category: category,
+		port:     strconv.Itoa(port),
+	}
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.allowedAddr(conn.RemoteAddr(), l.category, l.port) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
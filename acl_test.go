@@ -0,0 +1,120 @@
+package transproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewClientACLInvalid(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+	}{
+		{[]string{"10.0.0.0/33"}, nil},
+		{[]string{"client.example.org"}, nil},
+		{nil, []string{"10.0.0.256"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewClientACL(tt.allow, tt.deny); err == nil {
+			t.Errorf("allow %v, deny %v: accepted", tt.allow, tt.deny)
+		}
+	}
+}
+
+func TestClientACLAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{"empty lists", nil, nil, "192.0.2.1", true},
+		{"blank entries", []string{" "}, []string{""}, "192.0.2.1", true},
+		{"allowed CIDR", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"allowed IP", []string{" 192.0.2.1 "}, nil, "192.0.2.1", true},
+		{"allowed IP only", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.129", false},
+		{"allowed besides denied", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.1", true},
+		{"IPv4-mapped IPv6", []string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{"allowed IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"denied IPv6", nil, []string{"2001:db8::1"}, "2001:db8::1", false},
+		{"IPv6 not in IPv4 list", []string{"192.0.2.0/24"}, nil, "2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		acl, err := NewClientACL(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := acl.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: %s allowed %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+
+	var none *ClientACL
+	if !none.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Error("denied by nil ACL")
+	}
+}
+
+func TestClientACLUpdate(t *testing.T) {
+	acl, _ := NewClientACL(nil, nil)
+	other, _ := NewClientACL(nil, []string{"192.0.2.1"})
+	acl.Update(other)
+	if acl.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Error("allowed after the update")
+	}
+}
+
+func TestACLListener(t *testing.T) {
+	tests := []struct {
+		name string
+		deny []string
+		want bool
+	}{
+		{"allowed", nil, true},
+		{"denied", []string{"127.0.0.0/8"}, false},
+	}
+	for _, tt := range tests {
+		acl, _ := NewClientACL(nil, tt.deny)
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newACLListener(inner, acl, "Test", 0)
+
+		accepted := make(chan bool, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				c.Write([]byte("x"))
+				c.Close()
+			}
+			accepted <- err == nil
+		}()
+
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 1)
+		_, err = c.Read(b)
+		c.Close()
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: read %v, want served %v", tt.name, err, tt.want)
+		}
+		if !tt.want && err != io.EOF {
+			t.Errorf("%s: %v, want EOF by closed connection", tt.name, err)
+		}
+
+		l.Close()
+		if got := <-accepted; got != tt.want {
+			t.Errorf("%s: accepted %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
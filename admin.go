@@ -0,0 +1,292 @@
+package transproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminServer serves the JSON API to inspect and control the running proxies.
+//
+//	GET    /api/mappings          the mapping table of domains and local IPs
+//	DELETE /api/mappings          flush the mappings not used by connections
+//	DELETE /api/mappings/{domain} delete the mapping of the domain
+//	GET    /api/connections       active connections with bytes and age
+//	DELETE /api/connections/{id}  force close the connection
+//	GET    /api/upstreams         health of the upstream proxies
+//	GET    /metrics               metrics in Prometheus text format
+//
+// Requests must have the "Authorization: Bearer <token>" header.
+type AdminServer struct {
+	AdminServerConfig
+
+	lock   sync.Mutex
+	server *http.Server
+}
+
+type AdminServerConfig struct {
+	// host:port, the host is 127.0.0.1 if it's empty
+	ListenAddress string
+	Token         string
+	Transproxy    *Transproxy
+}
+
+type adminMapping struct {
+	Domain      string    `json:"domain"`
+	IP          string    `json:"ip"`
+	Expires     time.Time `json:"expires"`
+	Connections int       `json:"connections"`
+}
+
+type adminConnection struct {
+	ID         uint64    `json:"id"`
+	Proxy      string    `json:"proxy"`
+	RemoteAddr string    `json:"remoteAddr"`
+	LocalAddr  string    `json:"localAddr"`
+	Host       string    `json:"host"`
+	Started    time.Time `json:"started"`
+	Age        string    `json:"age"`
+	Sent       int64     `json:"sent"`
+	Received   int64     `json:"received"`
+}
+
+type adminUpstream struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url"`
+	Priority  int        `json:"priority"`
+	Weight    int        `json:"weight"`
+	Healthy   bool       `json:"healthy"`
+	Latency   string     `json:"latency"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+func NewAdminServer(c AdminServerConfig) (*AdminServer, error) {
+	if c.Token == "" {
+		return nil, errors.New("The token of the admin API isn't configured")
+	}
+	addr, err := loopbackAddress(c.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	c.ListenAddress = addr
+	return &AdminServer{
+		AdminServerConfig: c,
+	}, nil
+}
+
+func (s *AdminServer) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/mappings", s.handleMappings)
+	mux.HandleFunc("/api/mappings/", s.handleMapping)
+	mux.HandleFunc("/api/connections", s.handleConnections)
+	mux.HandleFunc("/api/connections/", s.handleConnection)
+	mux.HandleFunc("/api/upstreams", s.handleUpstreams)
+	mux.Handle("/metrics", s.Transproxy.MetricsHandler())
+
+	server, err := listenHTTP("Admin", s.ListenAddress, s.authorize(mux))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.server = server
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *AdminServer) Stop() {
+	s.lock.Lock()
+	server := s.server
+	s.server = nil
+	s.lock.Unlock()
+
+	if server != nil {
+		shutdownHTTP("Admin", server)
+	}
+}
+
+func (s *AdminServer) authorize(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Printf("warn: category='Admin' remoteAddr='%s' Unauthorized request %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transproxy"`)
+			writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *AdminServer) handleMappings(w http.ResponseWriter, r *http.Request) {
+	dnsProxy := s.Transproxy.dnsProxy
+	switch r.Method {
+	case http.MethodGet:
+		mappings := []adminMapping{}
+		for _, l := range dnsProxy.Mappings() {
+			mappings = append(mappings, adminMapping{
+				Domain:      l.Domain,
+				IP:          l.IP.String(),
+				Expires:     l.Expires,
+				Connections: l.Connections,
+			})
+		}
+		writeJSON(w, http.StatusOK, mappings)
+	case http.MethodDelete:
+		n := dnsProxy.FlushMappings()
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *AdminServer) handleMapping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	domain := strings.TrimPrefix(r.URL.Path, "/api/mappings/")
+	err := s.Transproxy.dnsProxy.DeleteMapping(domain)
+	switch {
+	case err == ErrIPLeaseInUse:
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *AdminServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	now := time.Now()
+	conns := []adminConnection{}
+	for _, c := range s.Transproxy.Connections() {
+		conns = append(conns, adminConnection{
+			ID:         c.ID,
+			Proxy:      c.Proxy,
+			RemoteAddr: c.RemoteAddr,
+			LocalAddr:  c.LocalAddr,
+			Host:       c.Host,
+			Started:    c.Started,
+			Age:        now.Sub(c.Started).Round(time.Second).String(),
+			Sent:       c.Sent,
+			Received:   c.Received,
+		})
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (s *AdminServer) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/connections/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid connection ID")
+		return
+	}
+	if !s.Transproxy.CloseConnection(id) {
+		writeJSONError(w, http.StatusNotFound, "Not found the connection")
+		return
+	}
+	log.Printf("info: category='Admin' remoteAddr='%s' Force closed the connection %d", r.RemoteAddr, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	upstreams := []adminUpstream{}
+	for _, u := range s.Transproxy.upstreams.Status() {
+		a := adminUpstream{
+			Name:      u.Name,
+			URL:       u.URL,
+			Priority:  u.Priority,
+			Weight:    u.Weight,
+			Healthy:   u.Healthy,
+			Latency:   u.Latency.String(),
+			LastError: u.LastError,
+		}
+		if !u.LastCheck.IsZero() {
+			lastCheck := u.LastCheck
+			a.LastCheck = &lastCheck
+		}
+		upstreams = append(upstreams, a)
+	}
+	writeJSON(w, http.StatusOK, upstreams)
+}
+
+// loopbackAddress returns the address with 127.0.0.1 if the host is empty.
+func loopbackAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// listenHTTP starts the HTTP server of the management endpoint on the address.
+func listenHTTP(category, addr string, handler http.Handler) (*http.Server, error) {
+	log.Printf("info: Start listener on %s category='%s'", addr, category)
+
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Printf("warn: category='%s' Listening on a non-loopback address %s", category, addr)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error: category='%s' %s", category, err)
+		}
+	}()
+	return server, nil
+}
+
+func shutdownHTTP(category string, server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+	}
+	log.Printf("info: category='%s' Stopped listener", category)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
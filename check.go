@@ -0,0 +1,306 @@
+package transproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RouteHop explains a step of routing a name, the DNS query or a connection.
+type RouteHop struct {
+	Port     int    // 0 for the DNS query
+	Proxy    string // type of the proxy listening on the port, empty if none
+	Decision Decision
+	Via      string // how the query or the connection is handled
+}
+
+// Route explains how a name is routed.
+type Route struct {
+	Host        string
+	DNS         RouteHop
+	Connections []RouteHop
+}
+
+// CheckConfig validates the configuration without starting any listener.
+// It returns all problems found, or nil if the configuration is valid.
+func CheckConfig(c TransproxyConfig) []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	c, _, gatewayErr := applyGateway(c)
+	if gatewayErr != nil {
+		fail("%s", gatewayErr)
+	}
+
+	if len(c.DNSListenAddresses) == 0 {
+		fail("No DNS listen addresses")
+	}
+	for _, addr := range fixDNSServers(c.DNSListenAddresses) {
+		if err := checkListenAddress(addr); err != nil {
+			fail("Invalid DNS listen address: %s", err)
+		}
+	}
+
+	if c.ProxyBindAddress != "" && net.ParseIP(c.ProxyBindAddress) == nil {
+		fail("Invalid bind address: %s: Not an IP address", c.ProxyBindAddress)
+	}
+	if _, err := NewClientACL(c.AllowClients, c.DenyClients); err != nil {
+		fail("%s", err)
+	}
+
+	listened := map[int]string{}
+	for _, p := range c.ProxyListenPorts {
+		if err := checkPort(p); err != nil {
+			fail("Invalid listen port: %s", err)
+		} else if _, ok := listened[p]; ok {
+			fail("Duplicated listen port: %d", p)
+		}
+		listened[p] = "Port"
+	}
+	for _, p := range c.HTTPForwardListenPorts {
+		if err := checkPort(p); err != nil {
+			fail("Invalid forward port: %s", err)
+		} else if other, ok := listened[p]; ok {
+			fail("Duplicated listen port: %d is also in %s", p, other)
+		}
+		listened[p] = "ForwardPort"
+	}
+	for _, p := range append(append([]int{}, c.SniffTLSPorts...), c.SniffHTTPPorts...) {
+		if err := checkPort(p); err != nil {
+			fail("Invalid sniff port: %s", err)
+		}
+	}
+	switch c.HostPolicy {
+	case "", HostPolicyPreferMapping, HostPolicyPreferSNI, HostPolicyReject:
+	default:
+		fail("Unknown host policy: %s", c.HostPolicy)
+	}
+
+	start := net.ParseIP(c.StartLocalIP).To4()
+	end := net.ParseIP(c.EndLocalIP).To4()
+	if gatewayErr == nil && (start == nil || end == nil || ip2int(start) > ip2int(end)) {
+		fail("Invalid local IP address range: %s-%s", c.StartLocalIP, c.EndLocalIP)
+	}
+	if c.SyntheticIPv6Prefix != "" {
+		if _, prefix, err := net.ParseCIDR(c.SyntheticIPv6Prefix); err != nil || !isSyntheticIPv6Prefix(prefix) {
+			fail("Invalid synthetic IPv6 prefix, it must be an IPv6 prefix of /96 or shorter: %s", c.SyntheticIPv6Prefix)
+		}
+	}
+
+	for _, s := range c.PrivateDNS {
+		if err := checkDNSServer(s); err != nil {
+			fail("Invalid DNS server: %s", err)
+		}
+	}
+	for _, s := range c.PublicDNS {
+		if err := checkDNSServer(s); err != nil {
+			fail("Invalid public DNS server: %s", err)
+		}
+	}
+	for _, s := range c.TunnelDNS {
+		if strings.HasPrefix(s, "https://") {
+			if _, err := url.Parse(s); err != nil {
+				fail("Invalid tunnel DNS server: %s", err)
+			}
+		} else if err := checkDNSServer(s); err != nil {
+			fail("Invalid tunnel DNS server: %s", err)
+		}
+	}
+
+	poolConfig := upstreamPoolConfig(c)
+	_, upstreams, upstreamsErr := newUpstreams(poolConfig)
+	if upstreamsErr != nil {
+		fail("%s", upstreamsErr)
+	}
+	noProxy := append([]string{}, c.NoProxy...)
+	for _, u := range poolConfig.Upstreams {
+		if u.URL != nil {
+			noProxy = append(noProxy, u.URL.Hostname())
+		}
+	}
+	if _, err := NewRules(c.Rules, noProxy); err != nil {
+		fail("%s", err)
+	}
+	for i, r := range c.Rules {
+		if r.Upstream != "" && upstreamsErr == nil && findUpstream(upstreams, r.Upstream) == nil {
+			if u, err := url.Parse(r.Upstream); err != nil || u.Host == "" {
+				fail("Invalid rule #%d '%s': Unknown upstream: %s", i+1, r.Match, r.Upstream)
+			}
+		}
+	}
+
+	if c.AdminListenAddress != "" {
+		if _, err := NewAdminServer(AdminServerConfig{ListenAddress: c.AdminListenAddress, Token: c.AdminToken}); err != nil {
+			fail("Invalid admin API: %s", err)
+		}
+	}
+	if c.MetricsListenAddress != "" {
+		if _, err := loopbackAddress(c.MetricsListenAddress); err != nil {
+			fail("Invalid metrics address: %s", err)
+		}
+	}
+
+	return errs
+}
+
+// ExplainRoute explains how the host is routed by the configuration without
+// starting any listener. Connections are explained for the port, or for all
+// listen ports if it's 0.
+func ExplainRoute(c TransproxyConfig, host string, port int) (Route, error) {
+	route := Route{Host: normalizeHost(host)}
+
+	c, _, err := applyGateway(c)
+	if err != nil {
+		return route, err
+	}
+
+	poolConfig := upstreamPoolConfig(c)
+	poolConfig, upstreams, err := newUpstreams(poolConfig)
+	if err != nil {
+		return route, err
+	}
+	noProxy := append([]string{}, c.NoProxy...)
+	for _, u := range upstreams {
+		noProxy = append(noProxy, u.URL.Hostname())
+	}
+	rules, err := NewRules(c.Rules, noProxy)
+	if err != nil {
+		return route, err
+	}
+
+	privateDNS := "the system DNS servers"
+	if servers := fixDNSServers(c.PrivateDNS); len(servers) > 0 {
+		privateDNS = strings.Join(servers, ", ")
+	}
+
+	d := rules.Match(route.Host, 0)
+	route.DNS = RouteHop{Decision: d}
+	switch {
+	case net.ParseIP(route.Host) != nil:
+		route.DNS.Via = "Not queried, clients connect to the IP address without transproxy unless it's in the local IP range"
+	case d.Action == ActionBlock:
+		route.DNS.Via = "Replied NXDOMAIN"
+	case d.Action == ActionPrivate:
+		route.DNS.Via = "Forwarded to " + privateDNS + ", clients connect to the address without transproxy"
+		return route, nil
+	default:
+		route.DNS.Via = fmt.Sprintf("Replied a synthetic IP address in %s-%s", c.StartLocalIP, c.EndLocalIP)
+	}
+
+	ports := map[int]string{}
+	for _, p := range c.ProxyListenPorts {
+		ports[p] = "PassThrough"
+	}
+	for _, p := range c.HTTPForwardListenPorts {
+		ports[p] = "HTTP-Forward"
+	}
+	targets := []int{port}
+	if port == 0 {
+		targets = []int{}
+		for p := range ports {
+			targets = append(targets, p)
+		}
+		sort.Ints(targets)
+	}
+
+	for _, p := range targets {
+		d := rules.Match(route.Host, p)
+		hop := RouteHop{Port: p, Proxy: ports[p], Decision: d}
+		switch {
+		case hop.Proxy == "":
+			hop.Via = "Refused, the port isn't listened"
+		case d.Action == ActionBlock:
+			hop.Via = "Rejected"
+		case d.Action == ActionDirect, d.Action == ActionPrivate:
+			hop.Via = "Connected directly to the address resolved by " + privateDNS
+		case d.Upstream != "":
+			if u := findUpstream(upstreams, d.Upstream); u != nil {
+				hop.Via = fmt.Sprintf("Through the upstream %s (%s)", u.Name, RedactURL(u.URL))
+			} else {
+				hop.Via = "Through the upstream " + d.Upstream
+			}
+		default:
+			names := []string{}
+			for _, u := range sortedUpstreams(upstreams) {
+				names = append(names, fmt.Sprintf("%s (%s)", u.Name, RedactURL(u.URL)))
+			}
+			hop.Via = fmt.Sprintf("Through the upstreams by %s policy: %s", poolConfig.Policy, strings.Join(names, ", "))
+		}
+		route.Connections = append(route.Connections, hop)
+	}
+
+	return route, nil
+}
+
+// findUpstream returns the upstream of the name, or nil if it's not found.
+func findUpstream(upstreams []*upstream, name string) *upstream {
+	for _, u := range upstreams {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// sortedUpstreams returns the upstreams in the order of the priority.
+func sortedUpstreams(upstreams []*upstream) []*upstream {
+	list := append([]*upstream{}, upstreams...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Priority < list[j].Priority
+	})
+	return list
+}
+
+func checkPort(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("%d isn't in the range 1-65535", port)
+	}
+	return nil
+}
+
+// checkListenAddress checks the address is [IP]:port.
+func checkListenAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("%s: Not an IP address", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%s: The port isn't number", addr)
+	}
+	if err := checkPort(p); err != nil {
+		return fmt.Errorf("%s: %s", addr, err)
+	}
+	return nil
+}
+
+// checkDNSServer checks the DNS server is IP[:port].
+func checkDNSServer(server string) error {
+	fixed := fixDNSServers([]string{server})
+	if len(fixed) == 0 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(fixed[0])
+	if err != nil {
+		return fmt.Errorf("%s: %s", server, err)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%s: Not an IP address", server)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%s: The port isn't number", server)
+	}
+	if err := checkPort(p); err != nil {
+		return fmt.Errorf("%s: %s", server, err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package transproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownGracePeriod = 10 * time.Second
+
+	// forceCloseWaitTimeout limits waiting for the handlers of force closed connections
+	forceCloseWaitTimeout = 5 * time.Second
+)
+
+// lastConnID is the last ID of tracked connections, unique in the process.
+var lastConnID uint64
+
+// ConnInfo is a snapshot of an active connection.
+type ConnInfo struct {
+	ID         uint64
+	Proxy      string // type of the proxy
+	RemoteAddr string
+	LocalAddr  string
+	Host       string // host:port of the destination, empty while resolving
+	Started    time.Time
+	Sent       int64
+	Received   int64
+}
+
+// connTracker tracks active client connections and their upstream connections
+// for graceful shutdown.
+type connTracker struct {
+	lock    sync.Mutex
+	wg      *sync.WaitGroup // handlers of the current start, replaced by reset
+	closing bool
+	conns   map[*trackedConn]struct{}
+}
+
+// trackedConn is a client connection and its upstream connection.
+type trackedConn struct {
+	id       uint64
+	client   net.Conn
+	started  time.Time
+	host     string
+	upstream io.Closer
+	relay    *relay
+	closed   bool            // force closed
+	wg       *sync.WaitGroup // of the start which opened it
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		wg:    &sync.WaitGroup{},
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// open starts tracking the client connection. It returns false if the tracker
+// is closing, then the caller must close the connection.
+func (t *connTracker) open(client net.Conn) (*trackedConn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closing {
+		return nil, false
+	}
+	tc := &trackedConn{
+		id:      atomic.AddUint64(&lastConnID, 1),
+		client:  client,
+		started: time.Now(),
+		wg:      t.wg,
+	}
+	t.conns[tc] = struct{}{}
+	tc.wg.Add(1)
+	return tc, true
+}
+
+// setUpstream tracks the upstream connection of the client to the host and the
+// relay between them. It returns false if the connection has been force closed,
+// then the caller must close the upstream.
+func (t *connTracker) setUpstream(tc *trackedConn, host string, upstream io.Closer, r *relay) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if tc.closed {
+		return false
+	}
+	tc.host = host
+	tc.upstream = upstream
+	tc.relay = r
+	return true
+}
+
+// close stops tracking the connection. The caller closes the connections.
+func (t *connTracker) close(tc *trackedConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.conns[tc]; ok {
+		delete(t.conns, tc)
+		tc.wg.Done()
+	}
+}
+
+// list returns the snapshot of the active connections in the order of the ID.
+func (t *connTracker) list(proxyType string) []ConnInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	conns := make([]ConnInfo, 0, len(t.conns))
+	for tc := range t.conns {
+		info := ConnInfo{
+			ID:         tc.id,
+			Proxy:      proxyType,
+			RemoteAddr: tc.client.RemoteAddr().String(),
+			LocalAddr:  tc.client.LocalAddr().String(),
+			Host:       tc.host,
+			Started:    tc.started,
+		}
+		if tc.relay != nil {
+			stats := tc.relay.Stats()
+			info.Sent = stats.Sent
+			info.Received = stats.Received
+		}
+		conns = append(conns, info)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// closeConn force closes the connection of the ID.
+// It returns false if it's not found.
+func (t *connTracker) closeConn(id uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for tc := range t.conns {
+		if tc.id == id {
+			tc.forceClose()
+			return true
+		}
+	}
+	return false
+}
+
+// reset allows to track connections again after shutdown. Handlers of the
+// previous start which are still running are counted apart from new ones.
+func (t *connTracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closing = false
+	t.wg = &sync.WaitGroup{}
+}
+
+// shutdown rejects new connections and waits for the active ones until the
+// context is done, then force closes them and waits for their handlers up to
+// forceCloseWaitTimeout. Handlers blocked in dialing the upstream might take
+// longer, they close the upstream connections by themselves. It returns the
+// number of force closed connections.
+func (t *connTracker) shutdown(ctx context.Context) int {
+	t.lock.Lock()
+	t.closing = true
+	wg := t.wg
+	t.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+
+	t.lock.Lock()
+	n := 0
+	for tc := range t.conns {
+		if tc.wg == wg {
+			tc.forceClose()
+			n++
+		}
+	}
+	t.lock.Unlock()
+
+	timer := time.NewTimer(forceCloseWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	return n
+}
+
+// forceClose closes the connections, the tracker lock must be held.
+func (tc *trackedConn) forceClose() {
+	tc.closed = true
+	if tc.relay != nil {
+		// the relay records the reason
+		tc.relay.closeBoth(CloseClosed)
+		return
+	}
+	tc.client.Close()
+	if tc.upstream != nil {
+		tc.upstream.Close()
+	}
+}
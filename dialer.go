@@ -0,0 +1,68 @@
+package transproxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// routeDialer connects to targets by routing decisions.
+type routeDialer struct {
+	dialer    *net.Dialer
+	upstreams *UpstreamPool
+	dnsProxy  *DNSProxy
+}
+
+func newRouteDialer(upstreams *UpstreamPool, dnsProxy *DNSProxy) *routeDialer {
+	return &routeDialer{
+		dialer: &net.Dialer{
+			KeepAlive: 3 * time.Minute,
+			DualStack: true,
+		},
+		upstreams: upstreams,
+		dnsProxy:  dnsProxy,
+	}
+}
+
+// Dial connects to the address by the decision.
+func (r *routeDialer) Dial(d Decision, network, addr string) (net.Conn, error) {
+	switch d.Action {
+	case ActionBlock:
+		return nil, errors.New("Blocked by rule: " + d.Rule)
+	case ActionDirect, ActionPrivate:
+		return r.DialDirect(network, addr)
+	default:
+		pdialer, err := r.upstream(d.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		return pdialer.Dial(network, addr)
+	}
+}
+
+// DialDirect connects to the address resolved by the private DNS servers.
+func (r *routeDialer) DialDirect(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := r.dnsProxy.ResolvePrivate(normalizeHost(host))
+	if err != nil {
+		return nil, err
+	}
+	return r.dialer.Dial(network, net.JoinHostPort(ip, port))
+}
+
+// upstream returns the dialer of the upstream proxy by the name or the URL.
+// It returns the upstream pool if it's empty.
+func (r *routeDialer) upstream(upstream string) (proxy.Dialer, error) {
+	if upstream == "" {
+		return r.upstreams, nil
+	}
+	if pdialer, ok := r.upstreams.Get(upstream); ok {
+		return pdialer, nil
+	}
+	return r.upstreams.urlDialer(upstream)
+}
@@ -13,64 +13,111 @@ import (
 	"github.com/miekg/dns"
 )
 
+// DNS types which are not defined in the dns package.
+const (
+	typeSVCB  uint16 = 64
+	typeHTTPS uint16 = 65
+)
+
+// syntheticTTL is the TTL in seconds of synthetic answers, and also the
+// lifetime of the IP lease renewed by them.
+const syntheticTTL = 60
+
 type DNSProxy struct {
 	DNSProxyConfig
-	udpServer *dns.Server
-	tcpServer *dns.Server
+	mux       *dns.ServeMux
+	servers   []*dns.Server
 	udpClient *dns.Client // used for fowarding to internal DNS
 	tcpClient *dns.Client // used for fowarding to internal DNS
 
-	lock         sync.Mutex
-	currentIP    uint32
-	startIP      uint32
-	endIP        uint32
-	ipMap        map[string]uint32
-	ipReverseMap map[uint32]string
+	allocator  *IPAllocator
+	ipv6Prefix *net.IPNet
 
 	dnsSettings interface{}
+	setup       bool // Setup has been called, Teardown is needed on Stop
+
+	// The DNS journal is restored once, and the host DNS settings are left
+	// to another running instance if it's in use
+	journalChecked bool
+	journalInUse   bool
+
+	lock          sync.RWMutex // guards PrivateDNS and systemDomains
+	systemDNS     []string     // DNS servers of the system before Setup
+	systemDomains []string     // search domains of the system, which are routed to the private DNS servers
 }
 
 type DNSProxyConfig struct {
-	DNSListenAddress string
-	DNSEnableUDP     bool
-	DNSEnableTCP     bool
-	PrivateDNS       []string
-	NoProxy          []string
-	StartLocalIP     string
-	EndLocalIP       string
+	// Listen addresses as host:port, the port is 53 if it's omitted
+	DNSListenAddresses []string
+	DNSEnableUDP       bool
+	DNSEnableTCP       bool
+	PrivateDNS         []string
+	NoProxy            []string
+	Rules              *Rules     // Routing rules, which are made of NoProxy if it's nil
+	ACL                *ClientACL // Clients allowed to query, all clients if it's nil
+	StartLocalIP       string
+	EndLocalIP         string
+	MappingStore       MappingStore
+
+	// DNS servers for public names of other types than A and AAAA.
+	// The types are replied with NODATA if it's empty.
+	PublicDNS []string
+
+	// Resolver for public names, which is used instead of PublicDNS.
+	// It also decides NXDOMAIN before synthesis.
+	PublicResolver Resolver
+
+	// IPv6 prefix of synthetic AAAA records, which embed the synthetic IPv4 address
+	// in the last 32 bits. AAAA queries are replied with NODATA if it's empty.
+	SyntheticIPv6Prefix string
+
+	// Path of resolv.conf which is rewritten by Setup on Linux, /etc/resolv.conf if it's empty
+	ResolvConf string
+
+	// Path of the journal of the original DNS settings of the host, which are
+	// restored on the next start after a crash. The default is by the OS.
+	DNSJournal string
 }
 
-func NewDNSProxy(c DNSProxyConfig) *DNSProxy {
+func NewDNSProxy(c DNSProxyConfig) (*DNSProxy, error) {
 
 	// fix dns address
-	dnsServers := []string{}
-	for _, dnsServer := range c.PrivateDNS {
-		if dnsServer != "" {
-			_, _, err := net.SplitHostPort(dnsServer)
-			if err != nil {
-				fixed := net.JoinHostPort(dnsServer, "53")
-				dnsServers = append(dnsServers, fixed)
-			}
+	c.PrivateDNS = fixDNSServers(c.PrivateDNS)
+	c.PublicDNS = fixDNSServers(c.PublicDNS)
+	c.DNSListenAddresses = fixDNSServers(c.DNSListenAddresses)
+
+	var ipv6Prefix *net.IPNet
+	if c.SyntheticIPv6Prefix != "" {
+		if _, prefix, err := net.ParseCIDR(c.SyntheticIPv6Prefix); err != nil || !isSyntheticIPv6Prefix(prefix) {
+			log.Printf("warn: category='DNS-Proxy' Invalid synthetic IPv6 prefix, it must be an IPv6 prefix of /96 or shorter: %s", c.SyntheticIPv6Prefix)
+		} else {
+			ipv6Prefix = prefix
 		}
 	}
-	c.PrivateDNS = dnsServers
 
-	// fix domains for DNS noproxy zones
-	var dnsNoProxy []string
-	for _, s := range c.NoProxy {
-		if !strings.HasSuffix(s, ".") {
-			s += "."
+	// Route no_proxy zones to private DNS without rules
+	if c.Rules == nil {
+		rules, err := NewRules(nil, c.NoProxy)
+		if err != nil {
+			log.Printf("warn: category='DNS-Proxy' %s", err)
 		}
-		dnsNoProxy = append(dnsNoProxy, s)
+		c.Rules = rules
 	}
-	c.NoProxy = dnsNoProxy
 
 	log.Printf("info: NoProxyZone: %s", c.NoProxy)
 
-	return &DNSProxy{
+	allocator, err := NewIPAllocator(
+		net.ParseIP(c.StartLocalIP),
+		net.ParseIP(c.EndLocalIP),
+		time.Duration(syntheticTTL)*time.Second,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s (StartLocalIP=%q, EndLocalIP=%q)", err, c.StartLocalIP, c.EndLocalIP)
+	}
+
+	s := &DNSProxy{
 		DNSProxyConfig: c,
-		udpServer:      nil,
-		tcpServer:      nil,
+		mux:            dns.NewServeMux(),
 		udpClient: &dns.Client{
 			Net:            "udp",
 			Timeout:        time.Duration(10) * time.Second,
@@ -81,143 +128,497 @@ func NewDNSProxy(c DNSProxyConfig) *DNSProxy {
 			Timeout:        time.Duration(10) * time.Second,
 			SingleInflight: true,
 		},
-		currentIP:    ip2int(net.ParseIP(c.StartLocalIP).To4()),
-		startIP:      ip2int(net.ParseIP(c.StartLocalIP).To4()),
-		endIP:        ip2int(net.ParseIP(c.EndLocalIP).To4()),
-		ipMap:        make(map[string]uint32),
-		ipReverseMap: make(map[uint32]string),
+		ipv6Prefix: ipv6Prefix,
+		allocator:  allocator,
 	}
+
+	// Restore the mapping table of the previous run
+	if c.MappingStore != nil {
+		mappings, err := c.MappingStore.Load()
+		if err != nil {
+			log.Printf("warn: category='DNS-Proxy' Can't load the mapping table: %s", err)
+		}
+		restored := 0
+		for _, m := range mappings {
+			ip := net.ParseIP(m.IP)
+			if ip == nil {
+				continue
+			}
+			if s.allocator.Restore(m.Domain, ip, m.Time) {
+				restored++
+			}
+		}
+		log.Printf("info: category='DNS-Proxy' Restored %d mappings", restored)
+	}
+
+	return s, nil
 }
 
-func (s *DNSProxy) NextIP(domain string) string {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+// NextIP returns the synthetic IP leased to the domain, leasing a new one if needed.
+func (s *DNSProxy) NextIP(domain string) (string, error) {
+	ip, err := s.allocator.Allocate(domain)
+	if err != nil {
+		return "", err
+	}
 
-	s.currentIP += uint32(1)
-	if s.currentIP > s.endIP {
-		s.currentIP = s.startIP
+	if s.MappingStore != nil {
+		if err := s.MappingStore.Save(Mapping{Domain: domain, IP: ip.String(), Time: time.Now()}); err != nil {
+			log.Printf("warn: category='DNS-Proxy' Can't save the mapping %s -> %s: %s", domain, ip, err)
+		}
 	}
-	s.ipMap[domain] = s.currentIP
-	s.ipReverseMap[s.currentIP] = domain
 
-	return int2ip(s.currentIP).String()
+	return ip.String(), nil
 }
 
 func (s *DNSProxy) Lookup(domain string) (string, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	v, ok := s.ipMap[domain]
+	v, ok := s.allocator.Lookup(domain)
 	if !ok {
 		return "", errors.New(fmt.Sprintf("Not found %s in the DNS cache", domain))
 	}
-	return int2ip(v).String(), nil
+	return v.String(), nil
 }
 
 func (s *DNSProxy) ReverseLookup(ip string) (string, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	v, ok := s.ipReverseMap[ip2int(net.ParseIP(ip).To4())]
+	addr := s.parseSyntheticIP(ip)
+	if addr == nil {
+		return "", errors.New(fmt.Sprintf("Invalid IP %s", ip))
+	}
+	v, ok := s.allocator.ReverseLookup(addr)
 	if !ok {
 		return "", errors.New(fmt.Sprintf("Not found %s in the reverse DNS cache", ip))
 	}
 	return v, nil
 }
 
-func (s *DNSProxy) Start() error {
-	log.Printf("info: Start listener on %s category='DNS-Proxy'", s.DNSListenAddress)
+// AcquireIP resolves the synthetic IP and keeps its lease while a connection uses it.
+// ReleaseIP must be called when the connection is closed.
+func (s *DNSProxy) AcquireIP(ip string) (string, error) {
+	addr := s.parseSyntheticIP(ip)
+	if addr == nil {
+		return "", errors.New(fmt.Sprintf("Invalid IP %s", ip))
+	}
+	return s.allocator.Acquire(addr)
+}
+
+func (s *DNSProxy) ReleaseIP(ip string) {
+	addr := s.parseSyntheticIP(ip)
+	if addr == nil {
+		return
+	}
+	s.allocator.Release(addr)
+}
+
+func (s *DNSProxy) privateDNS() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.PrivateDNS
+}
+
+// SetPrivateDNS replaces the private DNS servers. The DNS servers of the
+// system are used if it's empty.
+func (s *DNSProxy) SetPrivateDNS(servers []string) {
+	servers = fixDNSServers(servers)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(servers) == 0 {
+		servers = s.systemDNS
+	}
+	s.PrivateDNS = servers
+	log.Printf("info: category='DNS-Proxy' Use DNS servers: %s", servers)
+}
+
+// ResolvePrivate resolves the host to an IPv4 address by the private DNS servers.
+// It's used for connecting directly, the system resolver might be transproxy itself.
+func (s *DNSProxy) ResolvePrivate(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	var err error
+	for _, dnsServer := range s.privateDNS() {
+		var resp *dns.Msg
+		start := time.Now()
+		resp, _, err = s.udpClient.Exchange(req, dnsServer)
+		observeDNSForward("private", dnsServer, start, err)
+		if err != nil {
+			log.Printf("warn: category='DNS-Proxy' DNS request to %s failed. %s, %s", dnsServer, err, host)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String(), nil
+			}
+		}
+		return "", fmt.Errorf("Not found %s by private DNS (rcode=%s)", host, dns.RcodeToString[resp.Rcode])
+	}
+	if err == nil {
+		err = errors.New("No private DNS servers")
+	}
+	return "", err
+}
+
+// parseSyntheticIP parses the IP and returns the IPv4 address embedded
+// if it's a synthetic IPv6 address.
+func (s *DNSProxy) parseSyntheticIP(ip string) net.IP {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() != nil {
+		return addr
+	}
+	if s.ipv6Prefix == nil || !s.ipv6Prefix.Contains(addr) {
+		return nil
+	}
+	return net.IP(addr[12:16])
+}
+
+func (s *DNSProxy) AllocatorStats() IPAllocatorStats {
+	return s.allocator.Stats()
+}
 
+// Mappings returns the mapping table, the most recently used first.
+func (s *DNSProxy) Mappings() []IPLease {
+	return s.allocator.Leases()
+}
+
+// DeleteMapping deletes the mapping of the domain unless connections use it.
+// Clients might still connect to the IP by their DNS cache, then the host name
+// is recovered by sniffing.
+func (s *DNSProxy) DeleteMapping(domain string) error {
+	ip, err := s.allocator.Delete(domain)
+	if err != nil {
+		return err
+	}
+	log.Printf("info: category='DNS-Proxy' Deleted the mapping %s -> %s", domain, ip)
+	s.saveDeleted(domain, ip)
+	return nil
+}
+
+// FlushMappings deletes all mappings which connections don't use.
+// It returns the number of the deleted mappings.
+func (s *DNSProxy) FlushMappings() int {
+	deleted := s.allocator.Flush()
+	for _, l := range deleted {
+		s.saveDeleted(l.Domain, l.IP)
+	}
+	log.Printf("info: category='DNS-Proxy' Flushed %d mappings", len(deleted))
+	return len(deleted)
+}
+
+func (s *DNSProxy) saveDeleted(domain string, ip net.IP) {
+	if s.MappingStore == nil {
+		return
+	}
+	if err := s.MappingStore.Save(Mapping{Domain: domain, IP: ip.String(), Time: time.Now(), Deleted: true}); err != nil {
+		log.Printf("warn: category='DNS-Proxy' Can't save the deletion of the mapping %s -> %s: %s", domain, ip, err)
+	}
+}
+
+func (s *DNSProxy) Start() error {
 	// Setup DNS Handler
 	dnsHandle := func(w dns.ResponseWriter, req *dns.Msg) {
+		if !s.ACL.allowedAddr(w.RemoteAddr(), "DNS-Proxy", "dns") {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
 		if len(req.Question) == 0 {
 			dns.HandleFailed(w, req)
 			return
 		}
 
-		// Resolve by proxied private DNS
-		for _, domain := range s.NoProxy {
-			log.Printf("debug: category='DNS-Proxy' Checking DNS route, request: %s, no_proxy: %s", req.Question[0].Name, domain)
-			if strings.HasSuffix(req.Question[0].Name, domain) {
-				log.Printf("debug: category='DNS-Proxy' Matched! Routing to private DNS, request: %s, no_proxy: %s", req.Question[0].Name, domain)
-				s.handlePrivate(w, req)
-				return
-			}
+		qtype := qtypeString(req.Question[0].Qtype)
+		switch d := s.route(req.Question[0].Name); d.Action {
+		case ActionPrivate:
+			dnsQueries.With(qtype, "private").Inc()
+			// Resolve by proxied private DNS
+			log.Printf("debug: category='DNS-Proxy' Routing to private DNS, request: %s, rule: %s", req.Question[0].Name, d.Rule)
+			s.handlePrivate(w, req)
+		case ActionBlock:
+			dnsQueries.With(qtype, "blocked").Inc()
+			log.Printf("info: Blocked. category='DNS-Proxy' remoteAddr='%s' questionName='%s' rule='%s'", w.RemoteAddr(), req.Question[0].Name, d.Rule)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(m)
+		default:
+			dnsQueries.With(qtype, "public").Inc()
+			// Resolve self
+			s.handlePublic(w, req)
 		}
-
-		// Resolve self
-		s.handlePublic(w, req)
 	}
 
-	dns.HandleFunc(".", dnsHandle)
+	s.mux.HandleFunc(".", dnsHandle)
 
-	// Start DNS Server
-	if s.DNSEnableUDP {
-		s.udpServer = &dns.Server{
-			Addr:       s.DNSListenAddress,
-			Net:        "udp",
-			TsigSecret: nil,
-		}
+	// Restore the DNS settings left by a crashed run before anything else,
+	// so they are restored even if listening fails
+	inUse := !s.restoreJournal()
+
+	// Listen on all addresses before changing the DNS settings of the host
+	if err := s.listen(); err != nil {
+		return err
 	}
-	if s.DNSEnableTCP {
-		s.tcpServer = &dns.Server{
-			Addr:       s.DNSListenAddress,
-			Net:        "tcp",
-			TsigSecret: nil,
-		}
+
+	dnsServers, domains := []string{}, []string{}
+	if !inUse {
+		dnsServers, domains = s.Setup()
+		s.setup = true
 	}
 
-	dnsServers := s.Setup()
+	s.lock.Lock()
+	s.systemDNS = dnsServers
 	if len(dnsServers) > 0 && len(s.PrivateDNS) == 0 {
 		log.Printf("info: category='DNS-Proxy' Use DNS servers: %s", dnsServers)
 		s.PrivateDNS = dnsServers
 	}
+	s.systemDomains = domains
+	if len(domains) > 0 {
+		log.Printf("info: category='DNS-Proxy' Search domains of the system: %s", domains)
+	}
+	s.lock.Unlock()
 
-	go func() {
-		if s.udpServer != nil {
-			if err := s.udpServer.ListenAndServe(); err != nil {
-				log.Fatal("alert: category='DNS-Proxy' %s", err)
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Printf("error: category='DNS-Proxy' %s", err)
 			}
+		}(server)
+	}
+
+	return nil
+}
+
+// route routes the DNS query of the name. The search domains of the system are
+// routed to the private DNS servers like the domains of NoProxy, unless a rule
+// matches the name.
+func (s *DNSProxy) route(name string) Decision {
+	d := s.Rules.Match(name, 0)
+	if d.Rule != "default" {
+		return d
+	}
+
+	s.lock.RLock()
+	domains := s.systemDomains
+	s.lock.RUnlock()
+
+	host := normalizeHost(name)
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return Decision{Action: ActionPrivate, Rule: "." + domain + " => " + ActionPrivate + " (search domain)"}
 		}
-		if s.tcpServer != nil {
-			if err := s.tcpServer.ListenAndServe(); err != nil {
-				log.Fatal("alert: category='DNS-Proxy' %s", err)
+	}
+	return d
+}
+
+// listen opens UDP and TCP listeners of the listen addresses. They are closed
+// if any of them fails.
+func (s *DNSProxy) listen() error {
+	servers := []*dns.Server{}
+	closeAll := func() {
+		for _, server := range servers {
+			if server.PacketConn != nil {
+				server.PacketConn.Close()
+			}
+			if server.Listener != nil {
+				server.Listener.Close()
 			}
 		}
-	}()
+	}
+
+	for _, addr := range s.DNSListenAddresses {
+		log.Printf("info: Start listener on %s category='DNS-Proxy'", addr)
 
+		if s.DNSEnableUDP {
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			servers = append(servers, &dns.Server{
+				PacketConn: pc,
+				Handler:    s.mux,
+			})
+		}
+		if s.DNSEnableTCP {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			servers = append(servers, &dns.Server{
+				Listener: l,
+				Handler:  s.mux,
+			})
+		}
+	}
+	s.servers = servers
 	return nil
 }
 
+// localNameservers returns the IP addresses of the listen addresses on port 53,
+// which are set as the DNS servers of the host. Unspecified addresses are
+// replaced by the loopback address. It's empty if there is none, then the DNS
+// settings of the host are left untouched.
+func (s *DNSProxy) localNameservers() []string {
+	nameservers := []string{}
+	seen := map[string]bool{}
+	for _, addr := range s.DNSListenAddresses {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port != "53" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case host == "" || (ip != nil && ip.IsUnspecified() && ip.To4() != nil):
+			host = "127.0.0.1"
+		case ip == nil:
+			continue
+		case ip.IsUnspecified():
+			host = "::1"
+		}
+		if !seen[host] {
+			seen[host] = true
+			nameservers = append(nameservers, host)
+		}
+	}
+	return nameservers
+}
+
 func (s *DNSProxy) handlePublic(w dns.ResponseWriter, req *dns.Msg) {
 	log.Printf("debug: category='DNS-Proxy' DNS request. %#v, %s", req, req)
 
-	nextIP, err := s.Lookup(req.Question[0].Name)
-	if err != nil {
-		nextIP = s.NextIP(req.Question[0].Name)
-	}
+	q := req.Question[0]
 
-	// Reply response with 127.0.0.1 always for proxy
-	rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN A %s", req.Question[0].Name, nextIP))
+	var m *dns.Msg
+	var err error
+	switch q.Qtype {
+	case dns.TypeA:
+		m, err = s.synthesizeIfExists(req, false)
+	case dns.TypeAAAA:
+		if s.ipv6Prefix != nil {
+			m, err = s.synthesizeIfExists(req, true)
+		} else {
+			m, err = s.noDataIfExists(req)
+		}
+	case typeSVCB, typeHTTPS:
+		// Don't let browsers try ECH or QUIC by the hints
+		m, err = s.noDataIfExists(req)
+	default:
+		if s.PublicResolver != nil {
+			m, err = s.PublicResolver.Exchange(req)
+		} else if len(s.PublicDNS) > 0 {
+			m, err = s.exchange(w, req, "public", s.PublicDNS)
+		} else {
+			m = noData(req)
+		}
+	}
 	if err != nil {
 		log.Printf("error: category='DNS-Proxy' DNS response failed. %s, %#v, %s", err.Error(), req, req)
 		dns.HandleFailed(w, req)
 		return
 	}
+
+	// access logging
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	log.Printf("info: Resolved by public. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer='%v'", host, q.Name, qtypeString(q.Qtype), m.Answer)
+
+	w.WriteMsg(m)
+}
+
+// checkExists checks that the name has A records by the public resolver.
+// It returns a reply for the request if the name doesn't, or nil otherwise.
+// The check is skipped without the public resolver or when it fails.
+func (s *DNSProxy) checkExists(req *dns.Msg) *dns.Msg {
+	if s.PublicResolver == nil {
+		return nil
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(req.Question[0].Name, dns.TypeA)
+	resp, err := s.PublicResolver.Exchange(q)
+	if err != nil {
+		log.Printf("warn: category='DNS-Proxy' Can't check existence of %s, fallback to synthesis. %s", req.Question[0].Name, err)
+		return nil
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		m.RecursionAvailable = true
+		m.Ns = resp.Ns
+		return m
+	case dns.RcodeSuccess:
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == dns.TypeA {
+				return nil
+			}
+		}
+		m := noData(req)
+		m.Ns = resp.Ns
+		return m
+	}
+	return nil
+}
+
+func (s *DNSProxy) synthesizeIfExists(req *dns.Msg, ipv6 bool) (*dns.Msg, error) {
+	if m := s.checkExists(req); m != nil {
+		return m, nil
+	}
+	return s.synthesize(req, ipv6)
+}
+
+func (s *DNSProxy) noDataIfExists(req *dns.Msg) (*dns.Msg, error) {
+	if m := s.checkExists(req); m != nil {
+		return m, nil
+	}
+	return noData(req), nil
+}
+
+// synthesize replies the synthetic IP for proxy.
+func (s *DNSProxy) synthesize(req *dns.Msg, ipv6 bool) (*dns.Msg, error) {
+	name := req.Question[0].Name
+
+	nextIP, err := s.NextIP(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rr dns.RR
+	if ipv6 {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, s.ipv6Prefix.IP.To16())
+		copy(ip[12:], net.ParseIP(nextIP).To4())
+		rr, err = dns.NewRR(fmt.Sprintf("%s %d IN AAAA %s", name, syntheticTTL, ip))
+	} else {
+		rr, err = dns.NewRR(fmt.Sprintf("%s %d IN A %s", name, syntheticTTL, nextIP))
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
 	m.Answer = []dns.RR{rr}
 	m.Rcode = dns.RcodeSuccess
+	return m, nil
+}
 
-	// access logging
-	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-	log.Printf("info: Resolved by public. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer='%v'", host, req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype], m.Answer)
-
-	w.WriteMsg(m)
+// noData replies that the name exists but has no record of the type.
+func noData(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative, m.RecursionAvailable = true, true
+	m.Rcode = dns.RcodeSuccess
+	return m
 }
 
-func (s *DNSProxy) handlePrivate(w dns.ResponseWriter, req *dns.Msg) {
+// exchange forwards the request to the DNS servers of the route in order until one of them answers.
+func (s *DNSProxy) exchange(w dns.ResponseWriter, req *dns.Msg, route string, dnsServers []string) (*dns.Msg, error) {
 	var c *dns.Client
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		c = s.tcpClient
@@ -225,19 +626,33 @@ func (s *DNSProxy) handlePrivate(w dns.ResponseWriter, req *dns.Msg) {
 		c = s.udpClient
 	}
 
-	log.Printf("debug: category='DNS-Proxy' DNS request. %#v, %s", req, req)
-
 	var resp *dns.Msg
-	var err error
-	for _, dnsServer := range s.PrivateDNS {
+	err := errors.New("No DNS servers")
+	for _, dnsServer := range dnsServers {
+		start := time.Now()
 		resp, _, err = c.Exchange(req, dnsServer)
+		observeDNSForward(route, dnsServer, start, err)
 		if err != nil {
 			log.Printf("warn: category='DNS-Proxy' DNS request to %s failed. %s, %#v, %s", dnsServer, err, req, req)
 		} else {
-			break
+			return resp, nil
 		}
 	}
+	return nil, err
+}
+
+func observeDNSForward(route, server string, start time.Time, err error) {
+	if err != nil {
+		dnsForwardFailures.With(route, server).Inc()
+		return
+	}
+	dnsForwardDuration.With(route, server).ObserveDuration(start)
+}
 
+func (s *DNSProxy) handlePrivate(w dns.ResponseWriter, req *dns.Msg) {
+	log.Printf("debug: category='DNS-Proxy' DNS request. %#v, %s", req, req)
+
+	resp, _ := s.exchange(w, req, "private", s.privateDNS())
 	if resp == nil {
 		dns.HandleFailed(w, req)
 		return
@@ -246,33 +661,90 @@ func (s *DNSProxy) handlePrivate(w dns.ResponseWriter, req *dns.Msg) {
 	// access logging
 	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 	if len(resp.Answer) > 0 {
-		log.Printf("info: Resolved by private. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer='%v'", host, req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype], resp.Answer)
+		log.Printf("info: Resolved by private. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer='%v'", host, req.Question[0].Name, qtypeString(req.Question[0].Qtype), resp.Answer)
 	} else {
-		log.Printf("info: Resolved by private. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer=''", host, req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype])
+		log.Printf("info: Resolved by private. category='DNS-Proxy' remoteAddr='%s' questionName='%s' questionType='%s' answer=''", host, req.Question[0].Name, qtypeString(req.Question[0].Qtype))
 	}
 
 	w.WriteMsg(resp)
 }
 
+// restoreJournal restores the DNS settings left by a crashed run, only at
+// the first call. It returns false if the journal is in use by another
+// running instance, then the DNS settings of the host are left to it.
+func (s *DNSProxy) restoreJournal() bool {
+	if s.journalChecked {
+		return !s.journalInUse
+	}
+	s.journalChecked = true
+
+	restored, err := RestoreDNS(s.DNSJournal)
+	_, s.journalInUse = err.(*dnsJournalInUseError)
+	switch {
+	case s.journalInUse:
+		log.Printf("warn: category='DNS-Proxy' The DNS settings of the host aren't changed: %s", err)
+	case err != nil:
+		log.Printf("warn: category='DNS-Proxy' Can't restore the DNS settings of the previous run: %s", err)
+	case restored:
+		log.Printf("info: category='DNS-Proxy' Restored the DNS settings left by the previous run")
+	}
+	return !s.journalInUse
+}
+
 func (s *DNSProxy) Stop() {
 	log.Printf("info: category='DNS-Proxy' Shutting down DNS service on interrupt\n")
 
-	s.Teardown()
+	if s.setup {
+		s.setup = false
+		s.Teardown()
+	}
 
-	if s.udpServer != nil {
-		if err := s.udpServer.Shutdown(); err != nil {
-			log.Printf("warn: category='DNS-Proxy' %s", err)
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil {
+			// Not started yet
+			if server.PacketConn != nil {
+				server.PacketConn.Close()
+			}
+			if server.Listener != nil {
+				server.Listener.Close()
+			}
 		}
-		s.udpServer = nil
 	}
-	if s.tcpServer != nil {
-		if err := s.tcpServer.Shutdown(); err != nil {
+	s.servers = nil
+
+	if s.MappingStore != nil {
+		if err := s.MappingStore.Close(); err != nil {
 			log.Printf("warn: category='DNS-Proxy' %s", err)
 		}
-		s.tcpServer = nil
 	}
 }
 
+func fixDNSServers(servers []string) []string {
+	dnsServers := []string{}
+	for _, dnsServer := range servers {
+		if dnsServer == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		dnsServers = append(dnsServers, dnsServer)
+	}
+	return dnsServers
+}
+
+func isSyntheticIPv6Prefix(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	return bits == 8*net.IPv6len && ones <= 96
+}
+
+func qtypeString(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
 func ip2int(ip net.IP) uint32 {
 	if len(ip) == 16 {
 		return binary.BigEndian.Uint32(ip[12:16])
@@ -0,0 +1,134 @@
+package transproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// dnsJournalEntry is the original DNS settings of the host, which is written
+// before Setup changes them and removed after Teardown restores them. The
+// settings are specific to the OS.
+type dnsJournalEntry struct {
+	OS       string          `json:"os"`
+	PID      int             `json:"pid"`
+	Time     time.Time       `json:"time"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// dnsJournalInUseError is returned by RestoreDNS when the journal belongs to
+// a running process, whose DNS settings must not be reverted.
+type dnsJournalInUseError struct {
+	journal string
+	pid     int
+}
+
+func (e *dnsJournalInUseError) Error() string {
+	return fmt.Sprintf("The DNS journal %s is in use by the running process %d", e.journal, e.pid)
+}
+
+// RestoreDNS restores the DNS settings of the host from the journal left by
+// the run which didn't exit cleanly. It returns false if there is no journal,
+// and an error if the journal is in use by another running process.
+func RestoreDNS(journal string) (bool, error) {
+	if journal == "" {
+		journal = defaultDNSJournal()
+	}
+
+	b, err := ioutil.ReadFile(journal)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var entry dnsJournalEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return false, fmt.Errorf("Invalid DNS journal %s: %s", journal, err)
+	}
+	if entry.OS != runtime.GOOS {
+		return false, fmt.Errorf("The DNS journal %s is for %s", journal, entry.OS)
+	}
+	if entry.PID != os.Getpid() && processAlive(entry.PID) {
+		return false, &dnsJournalInUseError{journal: journal, pid: entry.PID}
+	}
+
+	log.Printf("info: category='DNS-Proxy' Restoring the DNS settings changed by pid %d at %s", entry.PID, entry.Time.Format(time.RFC3339))
+	if err := restoreDNSSettings(entry.Settings); err != nil {
+		return false, err
+	}
+	if err := os.Remove(journal); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// recordDNSSettings writes the original settings into the journal.
+func (s *DNSProxy) recordDNSSettings(settings interface{}) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(dnsJournalEntry{
+		OS:       runtime.GOOS,
+		PID:      os.Getpid(),
+		Time:     time.Now(),
+		Settings: raw,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	journal := s.dnsJournal()
+	if err := os.MkdirAll(filepath.Dir(journal), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(journal, b, 0600)
+}
+
+// clearDNSSettings removes the journal after the settings are restored.
+func (s *DNSProxy) clearDNSSettings() {
+	if err := os.Remove(s.dnsJournal()); err != nil && !os.IsNotExist(err) {
+		log.Printf("warn: category='DNS-Proxy' Can't remove the DNS journal: %s", err)
+	}
+}
+
+func (s *DNSProxy) dnsJournal() string {
+	if s.DNSJournal != "" {
+		return s.DNSJournal
+	}
+	return defaultDNSJournal()
+}
+
+// writeFileAtomic replaces the file by renaming a temporary file, so the file
+// is never left half written. The file is written in place if it can't be
+// renamed, e.g. resolv.conf bind mounted by containers.
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return ioutil.WriteFile(path, content, mode)
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode.Perm())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return ioutil.WriteFile(path, content, mode)
+	}
+	return nil
+}
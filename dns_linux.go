@@ -1,10 +1,285 @@
 package transproxy
 
-func (s *DNSProxy) Setup() []string {
-	// Not implemented!
-	return []string{}
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultResolvConf = "/etc/resolv.conf"
+
+	// resolv.conf of systemd-resolved with the upstream DNS servers, which is
+	// used when resolv.conf has the stub resolver only
+	systemdResolvConf = "/run/systemd/resolve/resolv.conf"
+
+	// The managed resolv.conf has the original in comments, so it's restored
+	// even if the DNS journal of the previous run is lost.
+	resolvConfHeader   = "# Generated by transproxy-light, the original is restored on exit."
+	resolvConfOriginal = "# original: "
+	resolvConfLink     = "# link: "
+)
+
+const defaultLinuxDNSJournal = "/var/lib/transproxy-light/dns-journal.json"
+
+// resolvConfSetting is the original resolv.conf, which is restored by Teardown.
+type resolvConfSetting struct {
+	Path    string      `json:"path"`
+	Content []byte      `json:"content"`
+	Mode    os.FileMode `json:"mode"`
+	Link    string      `json:"link,omitempty"` // target of the path if it was a symbolic link
+}
+
+func defaultDNSJournal() string {
+	return defaultLinuxDNSJournal
+}
+
+// Setup rewrites resolv.conf to point to the DNS listener, and returns the
+// original nameservers except loopback ones and the search domains.
+func (s *DNSProxy) Setup() ([]string, []string) {
+	path := s.ResolvConf
+	if path == "" {
+		path = defaultResolvConf
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Setup failed: %s", err)
+		return []string{}, []string{}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Setup failed: %s", err)
+		return []string{}, []string{}
+	}
+	link, _ := os.Readlink(path)
+
+	if original, originalLink, ok := parseManagedResolvConf(content); ok {
+		log.Printf("warn: category='DNS-Proxy[linux]' %s is left by the previous run, the original is restored on exit", path)
+		content = original
+		link = originalLink
+	}
+
+	domains := resolvConfDomains(content)
+	servers, loopback := resolvConfServers(content)
+	if len(servers) == 0 && loopback {
+		// Use the upstreams of systemd-resolved instead of the stub resolver
+		if c, err := ioutil.ReadFile(systemdResolvConf); err == nil {
+			servers, _ = resolvConfServers(c)
+		}
+	}
+
+	nameservers := s.localNameservers()
+	if len(nameservers) == 0 {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Setup skipped, no DNS listen address on port 53")
+		return servers, domains
+	}
+
+	setting := &resolvConfSetting{
+		Path:    path,
+		Content: content,
+		Mode:    info.Mode(),
+		Link:    link,
+	}
+	if err := s.recordDNSSettings(setting); err != nil {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Setup failed, can't write the DNS journal: %s", err)
+		return servers, domains
+	}
+
+	if err := writeFileAtomic(path, managedResolvConf(content, link, nameservers), info.Mode()); err != nil {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Setup failed: %s", err)
+		s.clearDNSSettings()
+		return servers, domains
+	}
+	s.dnsSettings = setting
+	log.Printf("info: category='DNS-Proxy[linux]' Changed %s to use nameservers %s", path, nameservers)
+
+	return servers, domains
 }
 
+// Teardown restores the original resolv.conf.
 func (s *DNSProxy) Teardown() {
-	// Not implemented!
+	setting, ok := s.dnsSettings.(*resolvConfSetting)
+	if !ok {
+		return
+	}
+	s.dnsSettings = nil
+
+	if err := setting.restore(); err != nil {
+		log.Printf("warn: category='DNS-Proxy[linux]' DNS Teardown failed: %s", err)
+		return
+	}
+	s.clearDNSSettings()
+	log.Printf("info: category='DNS-Proxy[linux]' Restored %s", setting.Path)
+}
+
+// restoreDNSSettings restores resolv.conf recorded in the DNS journal.
+func restoreDNSSettings(settings json.RawMessage) error {
+	var setting resolvConfSetting
+	if err := json.Unmarshal(settings, &setting); err != nil {
+		return err
+	}
+	if setting.Path == "" {
+		return errors.New("No path of resolv.conf in the DNS journal")
+	}
+	if err := setting.restore(); err != nil {
+		return err
+	}
+	log.Printf("info: category='DNS-Proxy[linux]' Restored %s", setting.Path)
+	return nil
+}
+
+// processAlive returns whether the process of the PID is running. A process
+// of another executable is regarded as dead, it reused the PID after a crash.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return true
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return true
+	}
+	return strings.TrimSuffix(exe, " (deleted)") == strings.TrimSuffix(self, " (deleted)")
+}
+
+func (c *resolvConfSetting) restore() error {
+	if current, err := ioutil.ReadFile(c.Path); err == nil && !isManagedResolvConf(current) {
+		// Another program has rewritten it, e.g. NetworkManager
+		log.Printf("warn: category='DNS-Proxy[linux]' %s is rewritten by another program, it's left untouched", c.Path)
+		return nil
+	}
+	if current, _ := os.Readlink(c.Path); c.Link != "" && current == c.Link {
+		// The link target was written in place
+		return ioutil.WriteFile(c.Path, c.Content, c.Mode)
+	}
+	if c.Link != "" {
+		return symlinkAtomic(c.Link, c.Path)
+	}
+	return writeFileAtomic(c.Path, c.Content, c.Mode)
+}
+
+// resolvConfServers returns the nameservers as host:port except loopback ones,
+// and whether loopback ones are excluded.
+func resolvConfServers(content []byte) ([]string, bool) {
+	servers := []string{}
+	loopback := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			continue
+		}
+		if ip.IsLoopback() {
+			// Avoid the loop to ourselves or the local stub resolver
+			loopback = true
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(fields[1], "53"))
+	}
+	return servers, loopback
+}
+
+// resolvConfDomains returns the domains of the search and domain lines.
+func resolvConfDomains(content []byte) []string {
+	domains := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || (fields[0] != "search" && fields[0] != "domain") {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			domain = normalizeHost(domain)
+			if domain == "" || seen[domain] {
+				continue
+			}
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// managedResolvConf returns resolv.conf which points to the DNS listener. The
+// search domains and options of the original are kept.
+func managedResolvConf(original []byte, link string, nameservers []string) []byte {
+	var b bytes.Buffer
+	b.WriteString(resolvConfHeader + "\n")
+	if link != "" {
+		b.WriteString(resolvConfLink + link + "\n")
+	}
+	lines := strings.Split(strings.TrimSuffix(string(original), "\n"), "\n")
+	for _, line := range lines {
+		b.WriteString(resolvConfOriginal + line + "\n")
+	}
+	b.WriteString("\n")
+	for _, nameserver := range nameservers {
+		b.WriteString("nameserver " + nameserver + "\n")
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain" || fields[0] == "options") {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// parseManagedResolvConf returns the original of the managed resolv.conf.
+func parseManagedResolvConf(content []byte) ([]byte, string, bool) {
+	if !isManagedResolvConf(content) {
+		return nil, "", false
+	}
+	var original bytes.Buffer
+	link := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, resolvConfOriginal):
+			original.WriteString(strings.TrimPrefix(line, resolvConfOriginal) + "\n")
+		case strings.HasPrefix(line, resolvConfLink):
+			link = strings.TrimPrefix(line, resolvConfLink)
+		}
+	}
+	return original.Bytes(), link, true
+}
+
+func isManagedResolvConf(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(resolvConfHeader+"\n"))
+}
+
+// symlinkAtomic replaces the path by the symbolic link to the target.
+func symlinkAtomic(target, path string) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".link")
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,261 @@
+package transproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testResolvConf = `# by DHCP
+search corp.example.org
+nameserver 192.0.2.53
+nameserver 127.0.0.53
+nameserver 2001:db8::53
+options edns0
+`
+
+// tempResolvConf returns the DNS proxy which manages resolv.conf in a temporary directory.
+func tempResolvConf(t *testing.T) (*DNSProxy, string) {
+	dir, err := ioutil.TempDir("", "resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DNSProxy{
+		DNSProxyConfig: DNSProxyConfig{
+			DNSListenAddresses: []string{"127.0.0.1:53", "[::1]:53"},
+			ResolvConf:         filepath.Join(dir, "resolv.conf"),
+			DNSJournal:         filepath.Join(dir, "dns-journal.json"),
+		},
+	}, dir
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestResolvConfSetupTeardown(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(s.ResolvConf, []byte(testResolvConf), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, domains := s.Setup()
+	if want := []string{"192.0.2.53:53", "[2001:db8::53]:53"}; !reflect.DeepEqual(servers, want) {
+		t.Errorf("servers %v, want %v", servers, want)
+	}
+	if want := []string{"corp.example.org"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains %v, want %v", domains, want)
+	}
+	managed := readFile(t, s.ResolvConf)
+	for _, line := range []string{resolvConfHeader, "nameserver 127.0.0.1", "nameserver ::1", "search corp.example.org", "options edns0"} {
+		if !strings.Contains(managed, line+"\n") {
+			t.Errorf("no %q in managed resolv.conf:\n%s", line, managed)
+		}
+	}
+	if strings.Contains(managed, "\nnameserver 192.0.2.53") {
+		t.Errorf("original nameserver in managed resolv.conf:\n%s", managed)
+	}
+	if !exists(s.DNSJournal) {
+		t.Error("no DNS journal after Setup")
+	}
+
+	s.Teardown()
+	if got := readFile(t, s.ResolvConf); got != testResolvConf {
+		t.Errorf("restored:\n%s", got)
+	}
+	if info, _ := os.Stat(s.ResolvConf); info.Mode().Perm() != 0640 {
+		t.Errorf("restored mode %s", info.Mode())
+	}
+	if exists(s.DNSJournal) {
+		t.Error("DNS journal left after Teardown")
+	}
+}
+
+func TestResolvConfLeftByPreviousRun(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	left := managedResolvConf([]byte(testResolvConf), "", []string{"127.0.0.1"})
+	if err := ioutil.WriteFile(s.ResolvConf, left, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original in the comments is used and restored
+	if servers, domains := s.Setup(); len(servers) != 2 || len(domains) != 1 {
+		t.Errorf("servers %v, domains %v", servers, domains)
+	}
+	s.Teardown()
+	if got := readFile(t, s.ResolvConf); got != testResolvConf {
+		t.Errorf("restored:\n%s", got)
+	}
+}
+
+func TestResolvConfSymlink(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "stub-resolv.conf")
+	if err := ioutil.WriteFile(target, []byte(testResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, s.ResolvConf); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Setup()
+	if link, err := os.Readlink(s.ResolvConf); err == nil {
+		t.Errorf("still the link to %s after Setup", link)
+	}
+	if got := readFile(t, target); got != testResolvConf {
+		t.Errorf("link target changed:\n%s", got)
+	}
+	if _, link, ok := parseManagedResolvConf([]byte(readFile(t, s.ResolvConf))); !ok || link != target {
+		t.Errorf("link in managed resolv.conf %q, %v", link, ok)
+	}
+
+	s.Teardown()
+	if link, err := os.Readlink(s.ResolvConf); err != nil || link != target {
+		t.Errorf("restored link %q, %v", link, err)
+	}
+	if got := readFile(t, target); got != testResolvConf {
+		t.Errorf("link target changed:\n%s", got)
+	}
+}
+
+func TestResolvConfRewrittenByOthers(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(s.ResolvConf, []byte(testResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Setup()
+	const foreign = "# by NetworkManager\nnameserver 198.51.100.53\n"
+	if err := ioutil.WriteFile(s.ResolvConf, []byte(foreign), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Teardown()
+	if got := readFile(t, s.ResolvConf); got != foreign {
+		t.Errorf("foreign resolv.conf changed:\n%s", got)
+	}
+	if exists(s.DNSJournal) {
+		t.Error("DNS journal left after Teardown")
+	}
+}
+
+func TestResolvConfNotOnPort53(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	s.DNSListenAddresses = []string{"127.0.0.1:5353"}
+	if err := ioutil.WriteFile(s.ResolvConf, []byte(testResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing answers on port 53, so resolv.conf is left untouched
+	servers, domains := s.Setup()
+	if want := []string{"192.0.2.53:53", "[2001:db8::53]:53"}; !reflect.DeepEqual(servers, want) {
+		t.Errorf("servers %v, want %v", servers, want)
+	}
+	if want := []string{"corp.example.org"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains %v, want %v", domains, want)
+	}
+	if got := readFile(t, s.ResolvConf); got != testResolvConf {
+		t.Errorf("resolv.conf changed:\n%s", got)
+	}
+	if exists(s.DNSJournal) {
+		t.Error("DNS journal after skipped Setup")
+	}
+	s.Teardown()
+	if got := readFile(t, s.ResolvConf); got != testResolvConf {
+		t.Errorf("resolv.conf changed by Teardown:\n%s", got)
+	}
+}
+
+func TestResolvConfRestoreJournal(t *testing.T) {
+	s, dir := tempResolvConf(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(s.ResolvConf, []byte(testResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crashed without Teardown
+	s.Setup()
+	restored, err := RestoreDNS(s.DNSJournal)
+	if !restored || err != nil {
+		t.Fatalf("restored %v, %v", restored, err)
+	}
+	if got := readFile(t, s.ResolvConf); got != testResolvConf {
+		t.Errorf("restored:\n%s", got)
+	}
+	if exists(s.DNSJournal) {
+		t.Error("DNS journal left after restored")
+	}
+	if restored, err := RestoreDNS(s.DNSJournal); restored || err != nil {
+		t.Errorf("restored again %v, %v", restored, err)
+	}
+}
+
+func TestResolvConfDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"search", "search corp.example\nnameserver 192.0.2.53\n", []string{"corp.example"}},
+		{"search list", "search corp.example dev.corp.example.\n", []string{"corp.example", "dev.corp.example"}},
+		{"domain", "domain Corp.Example\n", []string{"corp.example"}},
+		{"domain and search", "domain corp.example\nsearch corp.example lab.example\n", []string{"corp.example", "lab.example"}},
+		{"root", "search .\n", []string{}},
+		{"none", "nameserver 192.0.2.53\n# search corp.example\n", []string{}},
+	}
+	for _, tt := range tests {
+		if got := resolvConfDomains([]byte(tt.content)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseManagedResolvConf(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		link     string
+	}{
+		{"plain", testResolvConf, ""},
+		{"link", testResolvConf, "/run/systemd/resolve/stub-resolv.conf"},
+		{"no trailing newline", "nameserver 192.0.2.53", ""},
+	}
+	for _, tt := range tests {
+		managed := managedResolvConf([]byte(tt.original), tt.link, []string{"127.0.0.1"})
+		original, link, ok := parseManagedResolvConf(managed)
+		if !ok {
+			t.Errorf("%s: not managed", tt.name)
+			continue
+		}
+		want := strings.TrimSuffix(tt.original, "\n") + "\n"
+		if string(original) != want || link != tt.link {
+			t.Errorf("%s: got %q and link %q", tt.name, original, link)
+		}
+	}
+
+	for _, content := range []string{testResolvConf, "", "nameserver 127.0.0.1\n" + resolvConfHeader + "\n"} {
+		if _, _, ok := parseManagedResolvConf([]byte(content)); ok {
+			t.Errorf("%q: managed", content)
+		}
+	}
+	if !bytes.HasPrefix(managedResolvConf(nil, "", nil), []byte(resolvConfHeader)) {
+		t.Error("no header")
+	}
+}
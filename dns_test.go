@@ -0,0 +1,57 @@
+package transproxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocalNameservers(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen []string
+		want   []string
+	}{
+		{"loopback", []string{"127.0.0.1:53", "[::1]:53"}, []string{"127.0.0.1", "::1"}},
+		{"unspecified", []string{"0.0.0.0:53", "[::]:53"}, []string{"127.0.0.1", "::1"}},
+		{"duplicated", []string{"127.0.0.1:53", "0.0.0.0:53"}, []string{"127.0.0.1"}},
+		{"other port", []string{"127.0.0.1:5353"}, []string{}},
+		{"some on port 53", []string{"127.0.0.1:5353", "192.0.2.1:53"}, []string{"192.0.2.1"}},
+		{"none", nil, []string{}},
+	}
+	for _, tt := range tests {
+		s := &DNSProxy{DNSProxyConfig: DNSProxyConfig{DNSListenAddresses: tt.listen}}
+		if got := s.localNameservers(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDNSProxyRoute(t *testing.T) {
+	rules, err := NewRules([]RuleConfig{
+		{Match: "blocked.corp.example", Action: ActionBlock},
+	}, []string{"internal.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DNSProxy{
+		DNSProxyConfig: DNSProxyConfig{Rules: rules},
+		systemDomains:  []string{"corp.example"},
+	}
+
+	tests := []struct {
+		name   string
+		action string
+	}{
+		{"corp.example.", ActionPrivate},
+		{"WWW.Corp.Example.", ActionPrivate},
+		{"www.internal.example.", ActionPrivate},
+		{"blocked.corp.example.", ActionBlock},
+		{"corp.example.org.", ActionProxy},
+		{"notcorp.example.", ActionProxy},
+	}
+	for _, tt := range tests {
+		if d := s.route(tt.name); d.Action != tt.action {
+			t.Errorf("%s: got %s by %s, want %s", tt.name, d.Action, d.Rule, tt.action)
+		}
+	}
+}
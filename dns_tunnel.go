@@ -0,0 +1,250 @@
+package transproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// Resolver answers DNS requests.
+type Resolver interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+const (
+	tunnelDNSTimeout = 10 * time.Second
+
+	// TTL bounds of cached answers of TunnelResolver
+	tunnelDNSMinTTL = 5 * time.Second
+	tunnelDNSMaxTTL = 5 * time.Minute
+
+	tunnelDNSMaxCache = 4096
+)
+
+// TunnelResolver is a Resolver which sends DNS requests to public DNS servers
+// through the upstream proxy, by DNS over TCP or DNS over HTTPS.
+// Answers are cached for their TTL, and the TTLs are counted down in the cache.
+type TunnelResolver struct {
+	servers    []string
+	dialer     proxy.Dialer
+	httpClient *http.Client
+
+	lock  sync.Mutex
+	cache map[tunnelDNSKey]tunnelDNSEntry
+}
+
+// tunnelDNSKey is the key of cached answers. The answers differ by the class
+// and the DO bit, which requests DNSSEC records.
+type tunnelDNSKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+func newTunnelDNSKey(req *dns.Msg) tunnelDNSKey {
+	q := req.Question[0]
+	key := tunnelDNSKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+type tunnelDNSEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// NewTunnelResolver returns a TunnelResolver for the DNS servers, which are
+// IP[:port] for DNS over TCP or https:// URL for DNS over HTTPS.
+func NewTunnelResolver(servers []string, dialer proxy.Dialer) *TunnelResolver {
+	dnsServers := []string{}
+	for _, server := range servers {
+		if strings.HasPrefix(server, "https://") {
+			dnsServers = append(dnsServers, server)
+		} else {
+			dnsServers = append(dnsServers, fixDNSServers([]string{server})...)
+		}
+	}
+
+	return &TunnelResolver{
+		servers: dnsServers,
+		dialer:  dialer,
+		httpClient: &http.Client{
+			Timeout: tunnelDNSTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.Dial(network, addr)
+				},
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		cache: make(map[tunnelDNSKey]tunnelDNSEntry),
+	}
+}
+
+// Exchange answers the request by the DNS servers in order until one of them answers.
+func (r *TunnelResolver) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	key := newTunnelDNSKey(req)
+
+	if resp := r.cached(key); resp != nil {
+		// The answer might be cached for another spelling of the name
+		resp.Id = req.Id
+		resp.Question = append([]dns.Question(nil), req.Question...)
+		return resp, nil
+	}
+
+	var resp *dns.Msg
+	err := errors.New("No DNS servers")
+	for _, server := range r.servers {
+		if strings.HasPrefix(server, "https://") {
+			resp, err = r.exchangeHTTPS(req, server)
+		} else {
+			resp, err = r.exchangeTCP(req, server)
+		}
+		if err != nil {
+			log.Printf("warn: category='DNS-Proxy' DNS request to %s through proxy failed. %s, %s", server, err, q.Name)
+			continue
+		}
+		resp.Id = req.Id
+		r.store(key, resp)
+		return resp, nil
+	}
+	return nil, err
+}
+
+func (r *TunnelResolver) exchangeTCP(req *dns.Msg, server string) (*dns.Msg, error) {
+	c, err := r.dialer.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	co := &dns.Conn{Conn: c}
+	defer co.Close()
+
+	co.SetDeadline(time.Now().Add(tunnelDNSTimeout))
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	return co.ReadMsg()
+}
+
+func (r *TunnelResolver) exchangeHTTPS(req *dns.Msg, server string) (*dns.Msg, error) {
+	// RFC 8484 recommends ID 0 for HTTP caching
+	m := req.Copy()
+	m.Id = 0
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequest("POST", server, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/dns-message")
+	hreq.Header.Set("Accept", "application/dns-message")
+
+	hresp, err := r.httpClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS returns %s", hresp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *TunnelResolver) cached(key tunnelDNSKey) *dns.Msg {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.cache[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expires) {
+		delete(r.cache, key)
+		return nil
+	}
+
+	// Count down the TTLs by the age of the entry
+	msg := e.msg.Copy()
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				// The TTL field of OPT is the extended RCODE and flags
+				continue
+			}
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+func (r *TunnelResolver) store(key tunnelDNSKey, resp *dns.Msg) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	// Use the minimum TTL of the records, SOA gives the negative TTL
+	ttl := tunnelDNSMaxTTL
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < tunnelDNSMinTTL {
+		ttl = tunnelDNSMinTTL
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if len(r.cache) >= tunnelDNSMaxCache {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= tunnelDNSMaxCache {
+			return
+		}
+	}
+	r.cache[key] = tunnelDNSEntry{msg: resp.Copy(), stored: now, expires: now.Add(ttl)}
+}
@@ -0,0 +1,290 @@
+package transproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsTCPDialer is a proxy.Dialer whose connections are served by the handler
+// as a DNS server over TCP.
+type dnsTCPDialer struct {
+	handler func(req *dns.Msg) *dns.Msg
+
+	lock    sync.Mutex
+	queries int
+}
+
+func (d *dnsTCPDialer) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		co := &dns.Conn{Conn: server}
+		defer co.Close()
+		req, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+		d.lock.Lock()
+		d.queries++
+		d.lock.Unlock()
+		co.WriteMsg(d.handler(req))
+	}()
+	return client, nil
+}
+
+func (d *dnsTCPDialer) count() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.queries
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestTunnelResolverStore(t *testing.T) {
+	soa := "example.com. 30 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600"
+	tests := []struct {
+		name    string
+		rcode   int
+		answer  []string
+		ns      []string
+		wantTTL time.Duration // 0 if it isn't cached
+	}{
+		{"answer", dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1"}, nil, 60 * time.Second},
+		{"minimum of records", dns.RcodeSuccess, []string{
+			"www.example.com. 60 IN CNAME web.example.com.",
+			"web.example.com. 20 IN A 192.0.2.1",
+		}, nil, 20 * time.Second},
+		{"min TTL", dns.RcodeSuccess, []string{"www.example.com. 1 IN A 192.0.2.1"}, nil, tunnelDNSMinTTL},
+		{"max TTL", dns.RcodeSuccess, []string{"www.example.com. 86400 IN A 192.0.2.1"}, nil, tunnelDNSMaxTTL},
+		{"NXDOMAIN by SOA", dns.RcodeNameError, nil, []string{soa}, 30 * time.Second},
+		{"NODATA by SOA", dns.RcodeSuccess, nil, []string{soa}, 30 * time.Second},
+		{"NXDOMAIN without SOA", dns.RcodeNameError, nil, nil, tunnelDNSMaxTTL},
+		{"SERVFAIL", dns.RcodeServerFailure, nil, nil, 0},
+		{"REFUSED", dns.RcodeRefused, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		d := &dnsTCPDialer{handler: func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, tt.rcode)
+			for _, s := range tt.answer {
+				resp.Answer = append(resp.Answer, testRR(t, s))
+			}
+			for _, s := range tt.ns {
+				resp.Ns = append(resp.Ns, testRR(t, s))
+			}
+			return resp
+		}}
+		r := NewTunnelResolver([]string{"192.0.2.53"}, d)
+
+		req := new(dns.Msg)
+		req.SetQuestion("WWW.example.com.", dns.TypeA)
+		for i := 0; i < 2; i++ {
+			resp, err := r.Exchange(req)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if resp.Id != req.Id || resp.Rcode != tt.rcode {
+				t.Errorf("%s: got ID %d and %s", tt.name, resp.Id, dns.RcodeToString[resp.Rcode])
+			}
+		}
+
+		wantQueries := 1
+		if tt.wantTTL == 0 {
+			wantQueries = 2
+		}
+		if n := d.count(); n != wantQueries {
+			t.Errorf("%s: %d queries, want %d", tt.name, n, wantQueries)
+		}
+		e, ok := r.cache[tunnelDNSKey{name: "www.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}]
+		if ok != (tt.wantTTL > 0) {
+			t.Errorf("%s: cached %v", tt.name, ok)
+		}
+		if ok && e.expires.Sub(e.stored) != tt.wantTTL {
+			t.Errorf("%s: cached for %s, want %s", tt.name, e.expires.Sub(e.stored), tt.wantTTL)
+		}
+	}
+}
+
+func TestTunnelResolverCountdown(t *testing.T) {
+	d := &dnsTCPDialer{handler: func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{
+			testRR(t, "www.example.com. 60 IN CNAME web.example.com."),
+			testRR(t, "web.example.com. 30 IN A 192.0.2.1"),
+		}
+		resp.SetEdns0(4096, false)
+		return resp
+	}}
+	r := NewTunnelResolver([]string{"192.0.2.53"}, d)
+	key := tunnelDNSKey{name: "www.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}
+
+	// age moves the entry back in time
+	age := func(d time.Duration) {
+		e := r.cache[key]
+		e.stored = e.stored.Add(-d)
+		e.expires = e.expires.Add(-d)
+		r.cache[key] = e
+	}
+	exchange := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		resp, err := r.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	exchange()
+	age(20 * time.Second)
+	resp := exchange()
+	if n := d.count(); n != 1 {
+		t.Errorf("%d queries, want 1", n)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("CNAME TTL %d, want 40", ttl)
+	}
+	if ttl := resp.Answer[1].Header().Ttl; ttl != 10 {
+		t.Errorf("A TTL %d, want 10", ttl)
+	}
+	if opt := resp.IsEdns0(); opt == nil || opt.UDPSize() != 4096 {
+		t.Errorf("OPT changed: %v", opt)
+	}
+
+	// The cached message isn't changed by the countdown
+	age(5 * time.Second)
+	resp = exchange()
+	if ttl := resp.Answer[1].Header().Ttl; ttl != 5 {
+		t.Errorf("A TTL %d, want 5", ttl)
+	}
+
+	// Expired
+	age(10 * time.Second)
+	resp = exchange()
+	if n := d.count(); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+	if ttl := resp.Answer[1].Header().Ttl; ttl != 30 {
+		t.Errorf("A TTL %d, want 30", ttl)
+	}
+}
+
+func TestTunnelResolverCountdownToZero(t *testing.T) {
+	r := NewTunnelResolver(nil, nil)
+	key := tunnelDNSKey{name: "www.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{testRR(t, "www.example.com. 1 IN A 192.0.2.1")}
+
+	// Cached for the min TTL longer than the TTL of the record
+	r.store(key, msg)
+	e := r.cache[key]
+	e.stored = e.stored.Add(-3 * time.Second)
+	r.cache[key] = e
+
+	resp := r.cached(key)
+	if resp == nil {
+		t.Fatal("not cached")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("TTL %d, want 0", ttl)
+	}
+}
+
+func TestTunnelResolverFullCache(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{testRR(t, "www.example.com. 60 IN A 192.0.2.1")}
+	key := tunnelDNSKey{name: "www.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}
+
+	tests := []struct {
+		name    string
+		expired int // expired entries of the full cache
+		want    bool
+	}{
+		{"full", 0, false},
+		{"full with an expired entry", 1, true},
+		{"full of expired entries", tunnelDNSMaxCache, true},
+	}
+	for _, tt := range tests {
+		r := NewTunnelResolver(nil, nil)
+		now := time.Now()
+		for i := 0; i < tunnelDNSMaxCache; i++ {
+			expires := now.Add(time.Minute)
+			if i < tt.expired {
+				expires = now.Add(-time.Second)
+			}
+			k := tunnelDNSKey{name: fmt.Sprintf("host%d.example.com.", i), qtype: dns.TypeA, qclass: dns.ClassINET}
+			r.cache[k] = tunnelDNSEntry{msg: msg, stored: now.Add(-time.Minute), expires: expires}
+		}
+
+		r.store(key, msg)
+		if _, ok := r.cache[key]; ok != tt.want {
+			t.Errorf("%s: stored %v, want %v", tt.name, ok, tt.want)
+		}
+		if want := tunnelDNSMaxCache - tt.expired + 1; tt.want && len(r.cache) != want {
+			t.Errorf("%s: %d entries, want %d", tt.name, len(r.cache), want)
+		}
+	}
+}
+
+func TestTunnelResolverKey(t *testing.T) {
+	d := &dnsTCPDialer{handler: func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{testRR(t, req.Question[0].Name+" 60 IN A 192.0.2.1")}
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		return resp
+	}}
+	r := NewTunnelResolver([]string{"192.0.2.53"}, d)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qclass  uint16
+		do      bool
+		queries int // total queries after the exchange
+	}{
+		{"first", "www.example.com.", dns.ClassINET, false, 1},
+		{"cached", "www.example.com.", dns.ClassINET, false, 1},
+		{"another spelling", "WWW.Example.COM.", dns.ClassINET, false, 1},
+		{"DO bit", "www.example.com.", dns.ClassINET, true, 2},
+		{"DO bit cached", "Www.Example.Com.", dns.ClassINET, true, 2},
+		{"class", "www.example.com.", dns.ClassCHAOS, false, 3},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		req.Question[0].Qclass = tt.qclass
+		if tt.do {
+			req.SetEdns0(4096, true)
+		}
+		resp, err := r.Exchange(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if n := d.count(); n != tt.queries {
+			t.Errorf("%s: %d queries, want %d", tt.name, n, tt.queries)
+		}
+		if len(resp.Question) != 1 || resp.Question[0] != req.Question[0] {
+			t.Errorf("%s: question %v, want %v", tt.name, resp.Question, req.Question)
+		}
+		if resp.Id != req.Id {
+			t.Errorf("%s: ID %d, want %d", tt.name, resp.Id, req.Id)
+		}
+		if opt := resp.IsEdns0(); (opt != nil && opt.Do()) != tt.do {
+			t.Errorf("%s: DO bit of the answer %v", tt.name, opt)
+		}
+	}
+}
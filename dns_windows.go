@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	ps "github.com/gorillalabs/go-powershell"
 	"github.com/gorillalabs/go-powershell/backend"
@@ -23,6 +27,10 @@ type NetIPInterface struct {
 	Dhcp           int    `json:"Dhcp"`
 }
 
+type DNSClientGlobalSetting struct {
+	SuffixSearchList []string `json:"SuffixSearchList"`
+}
+
 type DNSSetting struct {
 	InterfaceIndex  int
 	InterfaceAlias  string
@@ -30,7 +38,10 @@ type DNSSetting struct {
 	ServerAddresses []string
 }
 
-func (s *DNSProxy) Setup() []string {
+// Setup points the DNS servers of the interfaces to the DNS listener, and
+// returns the original DNS servers except loopback ones and the DNS suffix
+// search list.
+func (s *DNSProxy) Setup() ([]string, []string) {
 	// DNS cache clear
 	exec.Command("ipconfig", "/flushdns").Run()
 
@@ -41,32 +52,48 @@ func (s *DNSProxy) Setup() []string {
 	shell, err := ps.New(back)
 	if err != nil {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
-		return []string{}
+		return []string{}, []string{}
 	}
 	defer shell.Exit()
 
 	stdout, _, err := shell.Execute("Get-DnsClientServerAddress -AddressFamily IPv4 | ConvertTo-Json")
 	if err != nil {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
-		return []string{}
+		return []string{}, []string{}
 	}
 	j := ([]byte)(stdout)
 	dnsServerAddresses := []DNSServerAddress{}
 	if err := json.Unmarshal(j, &dnsServerAddresses); err != nil {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
-		return []string{}
+		return []string{}, []string{}
 	}
 
 	stdout, _, err = shell.Execute("Get-NetIPInterface -AddressFamily IPv4 | ConvertTo-Json")
 	if err != nil {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
-		return []string{}
+		return []string{}, []string{}
 	}
 	j = ([]byte)(stdout)
 	netIPInterfaces := []NetIPInterface{}
 	if err := json.Unmarshal(j, &netIPInterfaces); err != nil {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
-		return []string{}
+		return []string{}, []string{}
+	}
+
+	// The DNS suffix search list is resolved by the original DNS servers
+	domains := []string{}
+	globalSetting := DNSClientGlobalSetting{}
+	stdout, _, err = shell.Execute("Get-DnsClientGlobalSetting | ConvertTo-Json")
+	if err == nil {
+		err = json.Unmarshal(([]byte)(stdout), &globalSetting)
+	}
+	if err != nil {
+		log.Printf("warn: category='DNS-Proxy[windows]' Can't get the DNS suffix search list: %s", err)
+	}
+	for _, suffix := range globalSetting.SuffixSearchList {
+		if suffix = normalizeHost(strings.TrimSpace(suffix)); suffix != "" {
+			domains = append(domains, suffix)
+		}
 	}
 
 	dnsServers := map[string]struct{}{}
@@ -95,58 +122,121 @@ func (s *DNSProxy) Setup() []string {
 		}
 	}
 
-	// Save curret settings into the memory for teardown
+	results := []string{}
+	for k, _ := range dnsServers {
+		results = append(results, k+":53")
+	}
+
+	// The settings are of IPv4 DNS servers
+	nameservers := []string{}
+	for _, nameserver := range s.localNameservers() {
+		if ip := net.ParseIP(nameserver); ip != nil && ip.To4() != nil {
+			nameservers = append(nameservers, nameserver)
+		}
+	}
+	if len(nameservers) == 0 {
+		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup skipped, no IPv4 DNS listen address on port 53")
+		return results, domains
+	}
+
+	// Save curret settings into the journal and the memory for teardown
+	if err := s.recordDNSSettings(currentSettings); err != nil {
+		log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed, can't write the DNS journal: %s", err)
+		return results, domains
+	}
 	s.dnsSettings = currentSettings
 
 	// Change DNS!
 	for _, setting := range currentSettings {
-		stdout, _, err = shell.Execute(fmt.Sprintf("Set-DnsClientServerAddress -InterfaceIndex %d -ServerAddresses (\"%s\")", setting.InterfaceIndex, "127.0.0.1"))
+		stdout, _, err = shell.Execute(fmt.Sprintf("Set-DnsClientServerAddress -InterfaceIndex %d -ServerAddresses (\"%s\")", setting.InterfaceIndex, strings.Join(nameservers, "\",\"")))
 		if err != nil {
 			log.Printf("warn: category='DNS-Proxy[windows]' DNS Setup failed: %s", err)
 		}
 	}
 
-	results := []string{}
-	for k, _ := range dnsServers {
-		results = append(results, k+":53")
-	}
-	return results
+	return results, domains
 }
 
 func (s *DNSProxy) Teardown() {
-	defer func() {
-		// DNS cache clear
-		exec.Command("ipconfig", "/flushdns").Run()
-	}()
-
 	settings, ok := s.dnsSettings.([]DNSSetting)
 	if !ok {
 		log.Printf("warn: category='DNS-Proxy[windows]' DNS Teardown failed: %v", settings)
 		return
 	}
+	s.dnsSettings = nil
+
+	if err := restoreDNSServerAddresses(settings); err != nil {
+		log.Printf("warn: category='DNS-Proxy[windows]' DNS Teardown failed: %s", err)
+		return
+	}
+	s.clearDNSSettings()
+}
+
+// restoreDNSSettings restores the DNS settings recorded in the DNS journal.
+func restoreDNSSettings(raw json.RawMessage) error {
+	settings := []DNSSetting{}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return err
+	}
+	return restoreDNSServerAddresses(settings)
+}
+
+func restoreDNSServerAddresses(settings []DNSSetting) error {
+	defer func() {
+		// DNS cache clear
+		exec.Command("ipconfig", "/flushdns").Run()
+	}()
 
 	// start a local powershell process
 	back := &backend.Local{}
 	shell, err := ps.New(back)
 	if err != nil {
-		log.Printf("warn: category='DNS-Proxy[windows]' DNS Teardown failed: %s", err)
-		return
+		return err
 	}
 
 	defer shell.Exit()
+	var lastErr error
 	for _, setting := range settings {
 		if setting.Dhcp {
 			_, _, err := shell.Execute(fmt.Sprintf("Set-DnsClientServerAddress -InterfaceIndex %d -ResetServerAddresses", setting.InterfaceIndex))
 			if err != nil {
-				log.Printf("warn: category='DNS-Proxy[windows]' DNS Teardown failed: %s", err)
+				lastErr = fmt.Errorf("%s: %s", setting.InterfaceAlias, err)
 			}
 
 		} else {
 			servers := strings.Join(setting.ServerAddresses, "\",\"")
 			_, _, err := shell.Execute(fmt.Sprintf("Set-DnsClientServerAddress -InterfaceIndex %d -ServerAddresses (\"%s\")", setting.InterfaceIndex, servers))
 			if err != nil {
-				log.Printf("warn: category='DNS-Proxy[windows]' DNS Teardown failed: %s", err)
+				lastErr = fmt.Errorf("%s: %s", setting.InterfaceAlias, err)
 			}
 		}
 	}
+	return lastErr
+}
+
+// processAlive returns whether the process of the PID is running.
+func processAlive(pid int) bool {
+	const stillActive = 259
+	if pid <= 0 {
+		return false
+	}
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access is denied for running processes of other users
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+func defaultDNSJournal() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "transproxy-light", "dns-journal.json")
 }
@@ -0,0 +1,303 @@
+package transproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDoctorTarget = "github.com" // serves 22, 80 and 443
+	doctorDNSTimeout    = 5 * time.Second
+)
+
+// DoctorCheck is the result of a check by Doctor.
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// Doctor diagnoses the environment with the configuration, the listen ports,
+// the upstream proxies and the private DNS servers, without starting the proxy.
+type Doctor struct {
+	DoctorConfig
+}
+
+type DoctorConfig struct {
+	TransproxyConfig
+
+	// Names resolved by the private DNS servers, the domains of NoProxy
+	// and the hosts of the upstream proxies if it's empty
+	SampleNames []string
+
+	// Host requested by CONNECT to the listen ports, the host of
+	// HealthCheckTarget or github.com if it's empty
+	TargetHost string
+}
+
+func NewDoctor(c DoctorConfig) *Doctor {
+	if c.TargetHost == "" {
+		if host, _, err := net.SplitHostPort(c.HealthCheckTarget); err == nil && host != "" {
+			c.TargetHost = host
+		} else {
+			c.TargetHost = defaultDoctorTarget
+		}
+	}
+	return &Doctor{
+		DoctorConfig: c,
+	}
+}
+
+// Run runs all checks and returns the results.
+func (d *Doctor) Run() []DoctorCheck {
+	checks := []DoctorCheck{}
+	checks = append(checks, d.checkListenPorts()...)
+	checks = append(checks, d.checkUpstreams()...)
+	checks = append(checks, d.checkPrivateDNS()...)
+	return checks
+}
+
+func (d *Doctor) checkListenPorts() []DoctorCheck {
+	checks := []DoctorCheck{}
+
+	for _, addr := range fixDNSServers(d.DNSListenAddresses) {
+		if d.DNSEnableUDP {
+			checks = append(checks, checkListen("udp", addr))
+		}
+		if d.DNSEnableTCP {
+			checks = append(checks, checkListen("tcp", addr))
+		}
+	}
+	ports := append(append([]int{}, d.ProxyListenPorts...), d.HTTPForwardListenPorts...)
+	for _, p := range ports {
+		checks = append(checks, checkListen("tcp", net.JoinHostPort(d.ProxyBindAddress, strconv.Itoa(p))))
+	}
+	return checks
+}
+
+func checkListen(network, addr string) DoctorCheck {
+	check := DoctorCheck{
+		Name: fmt.Sprintf("Listen on %s/%s", addr, network),
+	}
+
+	var err error
+	if network == "udp" {
+		var c net.PacketConn
+		if c, err = net.ListenPacket(network, addr); err == nil {
+			c.Close()
+		}
+	} else {
+		var l net.Listener
+		if l, err = net.Listen(network, addr); err == nil {
+			l.Close()
+		}
+	}
+
+	switch {
+	case err == nil:
+		check.Passed = true
+		check.Detail = "The port is free"
+	case isPermissionError(err):
+		check.Detail = err.Error()
+		check.Fix = "Run as root (Linux) or administrator (Windows) to listen on ports below 1024"
+	default:
+		check.Detail = err.Error()
+		check.Fix = "Stop the other process using the port, e.g. systemd-resolved or dnsmasq for port 53, or transproxy-light already running"
+	}
+	return check
+}
+
+func isPermissionError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	return os.IsPermission(err)
+}
+
+func (d *Doctor) checkUpstreams() []DoctorCheck {
+	poolConfig, upstreams, err := newUpstreams(upstreamPoolConfig(d.TransproxyConfig))
+	if err != nil {
+		return []DoctorCheck{
+			{
+				Name:   "Upstream proxies",
+				Detail: err.Error(),
+				Fix:    "Set ProxyURL (-proxy-url or http_proxy) or [[Upstream]] in config.toml",
+			},
+		}
+	}
+
+	checks := []DoctorCheck{}
+	for _, u := range sortedUpstreams(upstreams) {
+		reachable := d.checkReachable(u, poolConfig.Tunnel)
+		checks = append(checks, reachable)
+		if !reachable.Passed {
+			continue
+		}
+		for _, p := range d.ProxyListenPorts {
+			checks = append(checks, d.checkConnect(u, net.JoinHostPort(d.TargetHost, strconv.Itoa(p))))
+		}
+	}
+	return checks
+}
+
+func (d *Doctor) checkReachable(u *upstream, c TunnelConfig) DoctorCheck {
+	addr := proxyAddr(u.URL)
+	check := DoctorCheck{
+		Name: "Reach upstream " + u.Name,
+	}
+	if addr != u.Name {
+		check.Name += " (" + addr + ")"
+	}
+
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = defaultTunnelDialTimeout
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = "Check the host and the port of the proxy URL, the DNS of this host and the firewall"
+		return check
+	}
+	conn.Close()
+
+	check.Passed = true
+	check.Detail = fmt.Sprintf("Connected in %s", time.Since(start).Round(time.Millisecond))
+	return check
+}
+
+func (d *Doctor) checkConnect(u *upstream, target string) DoctorCheck {
+	check := DoctorCheck{
+		Name: fmt.Sprintf("CONNECT %s through %s", target, u.Name),
+	}
+
+	conn, err := u.dialer.Dial("tcp", target)
+	if err == nil {
+		conn.Close()
+		check.Passed = true
+		check.Detail = "Tunnel established"
+		return check
+	}
+
+	check.Detail = err.Error()
+	_, port, _ := net.SplitHostPort(target)
+	if perr, ok := err.(*ProxyError); ok {
+		switch perr.StatusCode {
+		case http.StatusProxyAuthRequired:
+			check.Fix = "Check the user name and the password in the proxy URL. For NTLM, set the domain as DOMAIN%5Cuser"
+		case http.StatusForbidden, http.StatusMethodNotAllowed:
+			check.Fix = fmt.Sprintf("The proxy doesn't allow CONNECT to port %s. Ask the proxy administrator, or use ForwardPort for plain HTTP", port)
+		default:
+			check.Fix = fmt.Sprintf("The proxy can't connect to %s. Check the target is reachable from the proxy", target)
+		}
+		return check
+	}
+	check.Fix = "Check the proxy URL and ProxyHandshakeTimeout. For https:// proxies, check [ProxyTLS]"
+	return check
+}
+
+func (d *Doctor) checkPrivateDNS() []DoctorCheck {
+	names := d.SampleNames
+	if len(names) == 0 {
+		names = d.defaultSampleNames()
+	}
+	servers := fixDNSServers(d.PrivateDNS)
+
+	checks := []DoctorCheck{}
+	if len(servers) == 0 {
+		for _, name := range names {
+			checks = append(checks, checkSystemResolve(name))
+		}
+		return checks
+	}
+	for _, server := range servers {
+		for _, name := range names {
+			checks = append(checks, checkResolve(server, name))
+		}
+	}
+	return checks
+}
+
+// defaultSampleNames returns the domains of NoProxy and the hosts of the upstream proxies.
+func (d *Doctor) defaultSampleNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		name = normalizeHost(strings.TrimPrefix(strings.TrimSpace(name), "."))
+		if name == "" || seen[name] || strings.ContainsAny(name, "*/") || net.ParseIP(name) != nil {
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	for _, s := range d.NoProxy {
+		add(s)
+	}
+	for _, u := range upstreamPoolConfig(d.TransproxyConfig).Upstreams {
+		if u.URL != nil {
+			add(u.URL.Hostname())
+		}
+	}
+	return names
+}
+
+func checkResolve(server, name string) DoctorCheck {
+	check := DoctorCheck{
+		Name: fmt.Sprintf("Resolve %s by %s", name, server),
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: doctorDNSTimeout,
+	}
+	resp, _, err := client.Exchange(req, server)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = "Check the address of the private DNS server (-dns) and the firewall"
+		return check
+	}
+
+	answers := []string{}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			answers = append(answers, a.A.String())
+		}
+	}
+	if len(answers) == 0 {
+		check.Detail = fmt.Sprintf("No A records (rcode=%s)", dns.RcodeToString[resp.Rcode])
+		check.Fix = "Check the name exists in the private network, or it's routed by NoProxy or rules by mistake"
+		return check
+	}
+
+	check.Passed = true
+	check.Detail = strings.Join(answers, ", ")
+	return check
+}
+
+func checkSystemResolve(name string) DoctorCheck {
+	check := DoctorCheck{
+		Name: fmt.Sprintf("Resolve %s by the system resolver", name),
+	}
+
+	addrs, err := net.LookupHost(name)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = "Set the private DNS servers by -dns (DNS in config.toml)"
+		return check
+	}
+
+	check.Passed = true
+	check.Detail = strings.Join(addrs, ", ")
+	return check
+}
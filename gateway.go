@@ -0,0 +1,134 @@
+package transproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+const gatewayDNSPort = "53"
+
+// Gateway routes the pool of the synthetic IP addresses to the local host by
+// an interface, so other hosts, containers and VMs which use this host as the
+// gateway and the DNS server can connect to the proxies.
+type Gateway struct {
+	GatewayConfig
+	pool    *net.IPNet
+	created bool // the interface was created by Setup
+	setup   bool // Setup has changed the interface, cleared by Teardown
+}
+
+type GatewayConfig struct {
+	// Interface which the pool is routed to, a dummy interface is created
+	// if it doesn't exist
+	Interface string
+
+	// Pool of the synthetic IP addresses as an IPv4 CIDR, e.g. 198.18.0.0/15.
+	// The first address is assigned to the interface.
+	Pool string
+}
+
+func NewGateway(c GatewayConfig) (*Gateway, error) {
+	if c.Interface == "" {
+		return nil, fmt.Errorf("No gateway interface")
+	}
+	pool, err := parseGatewayPool(c.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{
+		GatewayConfig: c,
+		pool:          pool,
+	}, nil
+}
+
+func parseGatewayPool(s string) (*net.IPNet, error) {
+	ip, pool, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gateway pool: %s", err)
+	}
+	ones, bits := pool.Mask.Size()
+	if ip.To4() == nil || bits != 32 {
+		return nil, fmt.Errorf("Invalid gateway pool, it must be an IPv4 CIDR: %s", s)
+	}
+	if ip.IsLoopback() {
+		return nil, fmt.Errorf("Invalid gateway pool, it must not be loopback addresses: %s", s)
+	}
+	if ones > 30 {
+		return nil, fmt.Errorf("Invalid gateway pool, it must be /30 or shorter: %s", s)
+	}
+	return pool, nil
+}
+
+// Address returns the address of the interface, which is the first address of the pool.
+func (g *Gateway) Address() net.IP {
+	return int2ip(ip2int(g.pool.IP.To4()) + 1)
+}
+
+// Range returns the range of the synthetic IP addresses, the pool except
+// the network, the interface and the broadcast addresses.
+func (g *Gateway) Range() (net.IP, net.IP) {
+	network := ip2int(g.pool.IP.To4())
+	ones, _ := g.pool.Mask.Size()
+	broadcast := network | (1<<uint(32-ones) - 1)
+	return int2ip(network + 2), int2ip(broadcast - 1)
+}
+
+// DNSListenAddress returns the address of the DNS proxy on the interface.
+func (g *Gateway) DNSListenAddress() string {
+	return net.JoinHostPort(g.Address().String(), gatewayDNSPort)
+}
+
+// applyGateway returns the configuration which allocates the synthetic IP
+// addresses from the gateway pool and listens DNS on the gateway interface.
+// It returns the configuration as is if the gateway mode is disabled.
+func applyGateway(c TransproxyConfig) (TransproxyConfig, *Gateway, error) {
+	if c.GatewayInterface == "" {
+		return c, nil, nil
+	}
+	g, err := NewGateway(GatewayConfig{
+		Interface: c.GatewayInterface,
+		Pool:      c.GatewayPool,
+	})
+	if err != nil {
+		return c, nil, err
+	}
+
+	// Other hosts can't use the proxies otherwise
+	if ip := net.ParseIP(c.ProxyBindAddress); ip != nil && ip.IsLoopback() {
+		return c, nil, fmt.Errorf("Invalid bind address in gateway mode, it must not be loopback: %s", c.ProxyBindAddress)
+	}
+	if loopbackOnly(c.AllowClients) {
+		return c, nil, fmt.Errorf("Only loopback clients are allowed in gateway mode, allow other hosts, containers and VMs by AllowClients, e.g. 192.168.0.0/16")
+	}
+
+	start, end := g.Range()
+	c.StartLocalIP = start.String()
+	c.EndLocalIP = end.String()
+
+	addr := g.DNSListenAddress()
+	listened := false
+	for _, a := range fixDNSServers(c.DNSListenAddresses) {
+		if a == addr {
+			listened = true
+		}
+	}
+	if !listened {
+		c.DNSListenAddresses = append(append([]string{}, c.DNSListenAddresses...), addr)
+	}
+	return c, g, nil
+}
+
+// loopbackOnly reports whether the allowed clients are loopback addresses
+// only. Invalid lists are reported by NewClientACL.
+func loopbackOnly(allow []string) bool {
+	nets, err := parseCIDRs(allow)
+	if err != nil || len(nets) == 0 {
+		return false
+	}
+	for _, n := range nets {
+		if !n.IP.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package transproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Setup routes the pool to the interface as local addresses, so connections
+// to the synthetic IP addresses are accepted by the proxy listeners. The
+// interface is created as a dummy interface if it doesn't exist.
+func (g *Gateway) Setup() error {
+	if _, err := net.InterfaceByName(g.Interface); err != nil {
+		if err := runIP("link", "add", g.Interface, "type", "dummy"); err != nil {
+			return err
+		}
+		g.created = true
+	}
+	g.setup = true
+
+	// Replace the address and the route left by the previous run
+	commands := [][]string{
+		{"link", "set", g.Interface, "up"},
+		{"addr", "replace", g.Address().String() + "/32", "dev", g.Interface},
+		{"route", "replace", "local", g.pool.String(), "dev", g.Interface},
+	}
+	for _, args := range commands {
+		if err := runIP(args...); err != nil {
+			g.Teardown()
+			return err
+		}
+	}
+
+	start, end := g.Range()
+	log.Printf("info: category='Gateway[linux]' Routed %s to %s (%s), local IP address range is %s-%s", g.pool, g.Interface, g.Address(), start, end)
+	return nil
+}
+
+// Teardown removes the route and the address, and the interface if it was
+// created by Setup. It does nothing if Setup hasn't changed the interface
+// or it has been removed.
+func (g *Gateway) Teardown() {
+	if !g.setup {
+		return
+	}
+	g.setup = false
+
+	if err := runIP("route", "del", "local", g.pool.String(), "dev", g.Interface); err != nil {
+		log.Printf("debug: category='Gateway[linux]' %s", err)
+	}
+	if g.created {
+		if err := runIP("link", "del", g.Interface); err != nil {
+			log.Printf("warn: category='Gateway[linux]' Gateway Teardown failed: %s", err)
+			return
+		}
+		g.created = false
+	} else if err := runIP("addr", "del", g.Address().String()+"/32", "dev", g.Interface); err != nil {
+		log.Printf("debug: category='Gateway[linux]' %s", err)
+	}
+	log.Printf("info: category='Gateway[linux]' Removed the route of %s from %s", g.pool, g.Interface)
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
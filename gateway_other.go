@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package transproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Setup isn't supported, the gateway mode needs local routes of Linux.
+func (g *Gateway) Setup() error {
+	return fmt.Errorf("Gateway mode isn't supported on %s", runtime.GOOS)
+}
+
+func (g *Gateway) Teardown() {
+}
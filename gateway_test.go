@@ -0,0 +1,48 @@
+package transproxy
+
+import "testing"
+
+func TestApplyGateway(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow       []string
+		bindAddress string
+		wantErr     bool
+	}{
+		{"all clients", nil, "", false},
+		{"LAN clients", []string{"127.0.0.0/8", "::1", "192.168.0.0/16"}, "", false},
+		{"loopback only", []string{"127.0.0.0/8", "::1"}, "", true},
+		{"loopback IP only", []string{" 127.0.0.1 "}, "", true},
+		{"bind address of LAN", []string{"192.168.0.0/16"}, "192.168.0.1", false},
+		{"loopback bind address", []string{"192.168.0.0/16"}, "127.0.0.1", true},
+		{"IPv6 loopback bind address", nil, "::1", true},
+	}
+	for _, tt := range tests {
+		c, g, err := applyGateway(TransproxyConfig{
+			GatewayInterface:   "transproxy0",
+			GatewayPool:        "198.18.0.0/15",
+			DNSListenAddresses: []string{"127.0.0.1:53"},
+			AllowClients:       tt.allow,
+			ProxyBindAddress:   tt.bindAddress,
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.StartLocalIP != "198.18.0.2" || c.EndLocalIP != "198.19.255.254" {
+			t.Errorf("%s: range %s - %s", tt.name, c.StartLocalIP, c.EndLocalIP)
+		}
+		if n := len(c.DNSListenAddresses); n != 2 || c.DNSListenAddresses[1] != g.DNSListenAddress() {
+			t.Errorf("%s: DNS listen addresses %v", tt.name, c.DNSListenAddresses)
+		}
+	}
+
+	// Disabled without the interface
+	c := TransproxyConfig{AllowClients: []string{"127.0.0.1"}, ProxyBindAddress: "127.0.0.1"}
+	if _, g, err := applyGateway(c); err != nil || g != nil {
+		t.Errorf("disabled: got %v, %v", g, err)
+	}
+}
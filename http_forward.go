@@ -0,0 +1,820 @@
+package transproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// HTTPForwardProxy is a transparent proxy for plain HTTP. It forwards client
+// requests to the upstream proxy as absolute-URI proxy requests instead of
+// CONNECT, for proxies which refuse CONNECT to port 80.
+type HTTPForwardProxy struct {
+	HTTPForwardProxyConfig
+	dialer  *routeDialer
+	tracker *connTracker // tunnels switched by upgrades
+
+	lock       sync.Mutex
+	server     *http.Server
+	stopped    chan struct{} // closed when stopping
+	done       chan struct{} // closed when stopped
+	transports map[string]*forwardTransport
+}
+
+type HTTPForwardProxyConfig struct {
+	ListenAddress string
+	Upstreams     *UpstreamPool
+	DNSProxy      *DNSProxy
+	HostPolicy    string // HostPolicyPreferMapping, HostPolicyPreferSNI or HostPolicyReject
+	Rules         *Rules
+
+	// Clients allowed to connect, all clients if it's nil
+	ACL *ClientACL
+
+	// Timeouts of tunnels switched by upgrades
+	Relay RelayConfig
+
+	// Active requests and tunnels are waited for the period on Stop, then force closed
+	ShutdownGracePeriod time.Duration
+}
+
+// max size of request bodies which are buffered to be resent after 407 responses of NTLM
+const maxForwardBodyBuffer = 1024 * 1024
+
+// Hop-by-hop headers, they are removed when forwarding.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func NewHTTPForwardProxy(c HTTPForwardProxyConfig) *HTTPForwardProxy {
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	return &HTTPForwardProxy{
+		HTTPForwardProxyConfig: c,
+		tracker:                newConnTracker(),
+		transports:             make(map[string]*forwardTransport),
+	}
+}
+
+func (s *HTTPForwardProxy) GetType() string {
+	return "HTTP-Forward-Proxy"
+}
+
+func (s *HTTPForwardProxy) GetListenPort() int {
+	_, port, _ := net.SplitHostPort(s.ListenAddress)
+	i, _ := strconv.Atoi(port)
+	return i
+}
+
+// Connections returns the active tunnels switched by upgrades.
+func (s *HTTPForwardProxy) Connections() []ConnInfo {
+	return s.tracker.list(s.GetType())
+}
+
+// CloseConnection force closes the tunnel of the ID.
+func (s *HTTPForwardProxy) CloseConnection(id uint64) bool {
+	return s.tracker.closeConn(id)
+}
+
+func (s *HTTPForwardProxy) Start() error {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts the listener. The proxy is stopped gracefully when
+// the context is done.
+func (s *HTTPForwardProxy) StartContext(ctx context.Context) error {
+	s.dialer = newRouteDialer(s.Upstreams, s.DNSProxy)
+
+	log.Printf("info: Start listener on %s category='%s'", s.ListenAddress, s.GetType())
+
+	l, err := net.Listen("tcp", s.ListenAddress)
+	if err != nil {
+		return err
+	}
+	l = newACLListener(l, s.ACL, s.GetType(), s.GetListenPort())
+
+	server := &http.Server{
+		Handler: s,
+	}
+	stopped := make(chan struct{})
+	s.lock.Lock()
+	s.server = server
+	s.stopped = stopped
+	s.done = make(chan struct{})
+	s.lock.Unlock()
+	s.tracker.reset()
+
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("warn: category='%s' Error accepting new connection - %s", s.GetType(), err.Error())
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-stopped:
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the proxy gracefully in the grace period.
+func (s *HTTPForwardProxy) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+	defer cancel()
+	s.StopContext(ctx)
+}
+
+// StopContext stops accepting new connections and waits for the active
+// requests and tunnels until the context is done, then force closes them.
+// It returns after all connections are closed, with the context error if
+// they were force closed.
+func (s *HTTPForwardProxy) StopContext(ctx context.Context) error {
+	s.lock.Lock()
+	server := s.server
+	done := s.done
+	s.server = nil
+	if server != nil {
+		close(s.stopped)
+	}
+	s.lock.Unlock()
+
+	if server == nil {
+		// already stopped or stopping by another call
+		if done == nil {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(done)
+
+	log.Printf("info: category='%s' Stopped listener on %s, draining connections", s.GetType(), s.ListenAddress)
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+	n := s.tracker.shutdown(ctx)
+
+	s.lock.Lock()
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+	s.lock.Unlock()
+
+	if err != nil || n > 0 {
+		log.Printf("warn: category='%s' Force closed connections after the grace period", s.GetType())
+		return ctx.Err()
+	}
+	return nil
+}
+
+// forwardTransport forwards requests directly or through an upstream, and
+// keeps the connections alive.
+type forwardTransport struct {
+	*http.Transport
+	dialer proxy.Dialer // dialer of the upstream, nil for direct
+	proxy  *httpDialer  // upstream HTTP proxy which receives absolute-URI requests
+}
+
+// transport returns the transport by the decision, which isn't ActionProxy
+// through the upstream pool.
+func (s *HTTPForwardProxy) transport(d Decision) (*forwardTransport, error) {
+	if d.Action == ActionDirect || d.Action == ActionPrivate {
+		return s.transportOf(ActionDirect, nil), nil
+	}
+	pdialer, err := s.dialer.upstream(d.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	return s.transportOf(d.Upstream, pdialer), nil
+}
+
+// transportOf returns the transport of the upstream dialer, nil for direct.
+// The transport of an upstream is replaced when its dialer is replaced by reload.
+func (s *HTTPForwardProxy) transportOf(key string, pdialer proxy.Dialer) *forwardTransport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.transports[key]
+	if ok && t.dialer == pdialer {
+		return t
+	}
+	if ok {
+		t.CloseIdleConnections()
+	}
+	t = s.newForwardTransport(pdialer)
+	s.transports[key] = t
+	return t
+}
+
+// roundTrip forwards the request by the decision. Requests through the
+// upstream pool are retried through the next upstream on errors of the
+// upstream like UpstreamPool.Dial, unless the body has been read.
+func (s *HTTPForwardProxy) roundTrip(d Decision, req *http.Request) (*http.Response, error) {
+	if d.Action != ActionProxy || d.Upstream != "" {
+		t, err := s.transport(d)
+		if err != nil {
+			return nil, err
+		}
+		return t.RoundTrip(req)
+	}
+
+	var err error
+	for _, u := range s.Upstreams.candidates() {
+		outreq := req
+		var body *retryBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &retryBody{ReadCloser: req.Body}
+			outreq = new(http.Request)
+			*outreq = *req
+			outreq.Body = body
+		}
+
+		var resp *http.Response
+		resp, err = s.transportOf(u.Name, u.dialer).RoundTrip(outreq)
+		if !s.Upstreams.dialed(u, err) {
+			return resp, err
+		}
+		log.Printf("warn: category='%s' Request %s through %s failed: %s", s.GetType(), absoluteURI(req), u.Name, err)
+		if body != nil && !body.detach() {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// retryBody is a request body which can be sent by another round trip
+// if the previous one failed without reading it.
+type retryBody struct {
+	io.ReadCloser
+	state int32 // 0: unread, 1: read, 2: detached
+}
+
+var errBodyDetached = errors.New("The request body is sent by another request")
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&b.state, 0, 1) && atomic.LoadInt32(&b.state) != 1 {
+		return 0, errBodyDetached
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Close doesn't close the body, which is closed by the server.
+func (b *retryBody) Close() error {
+	return nil
+}
+
+// detach reports whether the body hasn't been read, and stops the failed
+// round trip from reading it.
+func (b *retryBody) detach() bool {
+	return atomic.CompareAndSwapInt32(&b.state, 0, 2)
+}
+
+func (s *HTTPForwardProxy) newForwardTransport(pdialer proxy.Dialer) *forwardTransport {
+	t := &forwardTransport{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+			DisableCompression:  true,
+		},
+		dialer: pdialer,
+	}
+	switch pd := pdialer.(type) {
+	case nil:
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dialer.DialDirect(network, addr)
+		}
+	case *httpDialer:
+		// The proxy is connected with the timeouts and the TLS of the
+		// upstream like tunnels. The URL has no credentials, RoundTrip
+		// authenticates after 407.
+		t.proxy = pd
+		t.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: pd.addr})
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pd.dialProxyConn()
+		}
+	default:
+		// Requests to the target through a tunnel, e.g. of SOCKS5 proxies
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pd.Dial(network, addr)
+		}
+	}
+	return t
+}
+
+// RoundTrip forwards the request. It authenticates to the upstream HTTP proxy
+// like tunnels, by the negotiated scheme or the schemes which the proxy
+// requests by 407 responses. NTLM, which authenticates the connection, is
+// continued by roundTripNTLM on a dedicated connection.
+//
+// A request with a body can't be resent after a 407 response, except by
+// roundTripNTLM. The scheme is remembered then, so that the next requests
+// are authenticated without the 407.
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := t.proxy
+	if d == nil {
+		return t.Transport.RoundTrip(req)
+	}
+	if d.user != nil && d.negotiated() == authNTLM {
+		return t.roundTripNTLM(req)
+	}
+
+	target := absoluteURI(req)
+	auth, authz, err := d.newProxyAuth(req.Method, target)
+	if err != nil {
+		return nil, err
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+
+	for round := 0; ; round++ {
+		outreq := withProxyAuthorization(req, authz)
+		if hasBody && round > 0 {
+			if outreq.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.Transport.RoundTrip(outreq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			auth.accepted()
+			return resp, nil
+		}
+		if d.user == nil || round >= maxAuthRounds {
+			resp.Body.Close()
+			return nil, d.proxyError(resp, target, nil)
+		}
+
+		authz, _, err = auth.next(resp)
+		if err == nil && hasBody && req.GetBody == nil {
+			// The proxy requires the scheme, authenticate by it up front next time
+			d.setNegotiated(auth.scheme)
+			err = errors.New("The request body can't be resent")
+		}
+		if err != nil {
+			resp.Body.Close()
+			return nil, d.proxyError(resp, target, err)
+		}
+		if auth.scheme == authNTLM {
+			drainBody(resp)
+			return t.roundTripNTLM(req)
+		}
+
+		// The connection is reused if the body is drained
+		drainBody(resp)
+	}
+}
+
+// roundTripNTLM forwards the request authenticating by NTLM. The handshake
+// is done on a dedicated connection, which other requests can't take between
+// the challenge and the authenticate message, and the connection is closed
+// with the response body.
+//
+// Request bodies up to maxForwardBodyBuffer are buffered to be resent after
+// 407 responses. Negotiate messages, which the proxy answers by 407, are sent
+// by HEAD requests without the body, so that the body is sent only once with
+// the authenticate message.
+func (t *forwardTransport) roundTripNTLM(req *http.Request) (*http.Response, error) {
+	d := t.proxy
+	target := absoluteURI(req)
+	auth, authz, err := d.newProxyAuthScheme(authNTLM, req.Method, target)
+	if err != nil {
+		return nil, err
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		if req, err = bufferBody(req, maxForwardBodyBuffer); err != nil {
+			return nil, err
+		}
+	}
+	resendable := req.GetBody != nil
+	probing := hasBody
+	sent := false // the body has been sent
+
+	pt := t.newPinnedTransport()
+	for round := 0; ; round++ {
+		probe := probing && auth.negotiating()
+
+		outreq := withProxyAuthorization(req, authz)
+		switch {
+		case probe:
+			outreq.Method = http.MethodHead
+			outreq.Body = nil
+			outreq.GetBody = nil
+			outreq.ContentLength = 0
+		case hasBody && sent:
+			if outreq.Body, err = req.GetBody(); err != nil {
+				pt.Close()
+				return nil, err
+			}
+		case hasBody:
+			sent = true
+		}
+
+		resp, err := pt.RoundTrip(outreq)
+		if err != nil {
+			pt.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			if probe {
+				// The proxy doesn't require authentication, send the request
+				drainBody(resp)
+				probing = false
+				continue
+			}
+			auth.accepted()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				// The body of 101 is the connection, which the tunnel closes
+				resp.Body = &pinnedBody{ReadCloser: resp.Body, pt: pt}
+			}
+			return resp, nil
+		}
+		if round >= maxAuthRounds {
+			resp.Body.Close()
+			pt.Close()
+			return nil, d.proxyError(resp, target, nil)
+		}
+
+		var challenge *authChallenge
+		authz, challenge, err = auth.next(resp)
+		if err == nil && hasBody && sent && !resendable {
+			err = errors.New("The request body can't be resent")
+		}
+		if err != nil {
+			resp.Body.Close()
+			pt.Close()
+			return nil, d.proxyError(resp, target, err)
+		}
+
+		// The connection is reused if the body is drained
+		if !drainBody(resp) {
+			if auth.scheme == authNTLM && challenge.Token != "" {
+				pt.Close()
+				return nil, d.proxyError(resp, target, errNTLMConnectionClosed)
+			}
+		}
+	}
+}
+
+// pinnedTransport is a transport of a single connection to the proxy.
+// It fails to dial again after the connection is closed.
+type pinnedTransport struct {
+	*http.Transport
+
+	lock   sync.Mutex
+	conn   net.Conn
+	dialed bool
+}
+
+func (t *forwardTransport) newPinnedTransport() *pinnedTransport {
+	pt := &pinnedTransport{
+		Transport: t.Transport.Clone(),
+	}
+	pt.MaxConnsPerHost = 1
+	pt.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		pt.lock.Lock()
+		defer pt.lock.Unlock()
+
+		if pt.dialed {
+			return nil, errNTLMConnectionClosed
+		}
+		pt.dialed = true
+		c, err := t.proxy.dialProxyConn()
+		if err != nil {
+			return nil, err
+		}
+		pt.conn = c
+		return c, nil
+	}
+	return pt
+}
+
+// Close closes the connection.
+func (pt *pinnedTransport) Close() {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.dialed = true
+	if pt.conn != nil {
+		pt.conn.Close()
+	}
+}
+
+// pinnedBody is a response body which closes the pinned connection with it.
+type pinnedBody struct {
+	io.ReadCloser
+	pt *pinnedTransport
+}
+
+func (b *pinnedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.pt.Close()
+	return err
+}
+
+// withProxyAuthorization returns the copy of the request with the header.
+func withProxyAuthorization(req *http.Request, authz string) *http.Request {
+	outreq := new(http.Request)
+	*outreq = *req
+	if authz != "" {
+		outreq.Header = cloneHeader(req.Header)
+		outreq.Header.Set("Proxy-Authorization", authz)
+	}
+	return outreq
+}
+
+// drainBody reads and closes the response body to reuse the connection.
+// It returns false if the connection is closed.
+func drainBody(resp *http.Response) bool {
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxAuthBodySize+1))
+	resp.Body.Close()
+	return !resp.Close && err == nil && n <= maxAuthBodySize
+}
+
+// bufferBody returns the request with the body read in memory which can be
+// resent by GetBody. If the body is larger than the limit, the body of the
+// returned request reads the buffered bytes and the rest, and GetBody is nil.
+func bufferBody(req *http.Request, limit int64) (*http.Request, error) {
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+	r := new(http.Request)
+	*r = *req
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return r, nil
+	}
+	req.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return r, nil
+}
+
+// absoluteURI returns the request target which the transport sends to the proxy.
+func absoluteURI(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	return req.URL.Scheme + "://" + host + req.URL.RequestURI()
+}
+
+func (s *HTTPForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// access logging
+	localAddr := r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+	localHost, localPort, _ := net.SplitHostPort(localAddr)
+	remoteAddr := r.RemoteAddr
+
+	// Keep the IP lease while the request is processed
+	mappedHostName, err := s.DNSProxy.AcquireIP(localHost)
+	if err == nil {
+		defer s.DNSProxy.ReleaseIP(localHost)
+	}
+
+	headerHostName := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		headerHostName = h
+	}
+
+	hostName, err := chooseHost(mappedHostName, headerHostName, s.HostPolicy)
+	if err != nil {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' Can't resolve localAddr: %s", s.GetType(), remoteAddr, localAddr, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' resolvedHostName='%s' method='%s' uri='%s'", s.GetType(), remoteAddr, localAddr, hostName, r.Method, r.RequestURI)
+
+	port, _ := strconv.Atoi(localPort)
+	d := s.Rules.Match(hostName, port)
+	if d.Action == ActionBlock {
+		log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Blocked by rule: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, d.Rule)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	upgrade := isWebSocketUpgrade(r.Header)
+
+	outreq := r.WithContext(r.Context())
+	outreq.URL = &url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(strings.TrimSuffix(hostName, "."), localPort),
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	outreq.RequestURI = ""
+	if !strings.EqualFold(headerHostName, outreq.URL.Hostname()) {
+		// The absolute-URI is built from the Host
+		outreq.Host = outreq.URL.Host
+	}
+	outreq.Close = false
+	outreq.Header = cloneHeader(r.Header)
+	removeHopHeaders(outreq.Header)
+	if upgrade {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+	if r.ContentLength == 0 {
+		outreq.Body = nil
+	}
+
+	resp, err := s.roundTrip(d, outreq)
+	if err != nil {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Can't forward: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, err.Error())
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.tunnel(w, resp, hostName+":"+localPort, remoteAddr, localAddr)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if isStreaming(resp) {
+		dst = flushWriter{w}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		log.Printf("debug: category='%s' remoteAddr='%s' localAddr='%s' Response body copy failed: %s", s.GetType(), remoteAddr, localAddr, err)
+	}
+}
+
+// tunnel switches the client connection to a raw tunnel with the upgraded upstream connection.
+func (s *HTTPForwardProxy) tunnel(w http.ResponseWriter, resp *http.Response, host, remoteAddr, localAddr string) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' Upgraded response isn't writable", s.GetType(), remoteAddr, localAddr)
+		resp.Body.Close()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' Hijack failed: %s", s.GetType(), remoteAddr, localAddr, err)
+		upstream.Close()
+		return
+	}
+
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+
+	tc, ok := s.tracker.open(conn)
+	if !ok {
+		// shutting down
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	defer s.tracker.close(tc)
+
+	log.Printf("debug: category='%s' remoteAddr='%s' localAddr='%s' Switched to tunnel", s.GetType(), remoteAddr, localAddr)
+
+	// Bytes which the client sent after the request are buffered in brw
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	client := &replayConn{
+		Conn:   conn,
+		peeked: bytes.NewReader(append([]byte(nil), buffered...)),
+	}
+
+	port := strconv.Itoa(s.GetListenPort())
+	active := activeConnections.With(port)
+	active.Inc()
+	defer active.Add(-1)
+
+	r := newRelay(s.Relay, client, upstream)
+	r.countBytes(relayedBytes.With(port, "sent"), relayedBytes.With(port, "received"))
+	if !s.tracker.setUpstream(tc, host, upstream, r) {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	stats := r.Run()
+	log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' Tunnel closed, sent: %d, received: %d, duration: %s, reason: %s", s.GetType(), remoteAddr, localAddr, stats.Sent, stats.Received, stats.Duration, stats.Reason)
+}
+
+// isStreaming reports whether the response is streamed, e.g. chunked or
+// server-sent events. Its body is flushed to the client on every write like
+// httputil.ReverseProxy, others are buffered.
+func isStreaming(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// flushWriter flushes the response on every write.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func isWebSocketUpgrade(h http.Header) bool {
+	return headerContainsToken(h, "Connection", "upgrade") && strings.EqualFold(h.Get("Upgrade"), "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		h2[k] = vv2
+	}
+	return h2
+}
+
+func removeHopHeaders(h http.Header) {
+	// Headers listed in Connection are hop-by-hop too
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
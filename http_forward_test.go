@@ -0,0 +1,310 @@
+package transproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// authProxy is a stub of an upstream HTTP proxy which requires Basic or NTLM
+// authentication, and answers forwarded requests by the received body.
+type authProxy struct {
+	scheme string
+
+	lock       sync.Mutex
+	negotiated map[string]bool // connections which sent NTLM negotiate
+	sent       int             // body bytes received in all requests
+	methods    []string
+}
+
+func (p *authProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sent += len(body)
+	p.methods = append(p.methods, r.Method)
+
+	authz := r.Header.Get("Proxy-Authorization")
+	switch p.scheme {
+	case authBasic:
+		if authz != newBasicSession("user", "pass").authz {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	case authNTLM:
+		msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(authz, "NTLM "))
+		typ := uint32(0)
+		if len(msg) >= 12 && bytes.Equal(msg[:8], ntlmSignature) {
+			typ = binary.LittleEndian.Uint32(msg[8:])
+		}
+		switch {
+		case typ == 1:
+			p.negotiated[r.RemoteAddr] = true
+			w.Header().Set("Proxy-Authenticate", "NTLM "+ntlmTestChallenge(ntlmTestTargetInfo).Token)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		case typ == 3 && p.negotiated[r.RemoteAddr]:
+			delete(p.negotiated, r.RemoteAddr)
+		default:
+			w.Header().Set("Proxy-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	w.Write(body)
+}
+
+func TestForwardTransportPostWithAuth(t *testing.T) {
+	small := []byte("name=value")
+	large := bytes.Repeat([]byte("x"), maxForwardBodyBuffer+1)
+
+	tests := []struct {
+		name        string
+		scheme      string
+		get         bool // a GET request negotiates the scheme first
+		body        []byte
+		failFirst   bool // the first POST fails because the body can't be resent
+		wantSent    int  // body bytes which the proxy receives
+		wantMethods []string
+	}{
+		// Basic is sent without the 407 after the GET
+		{"basic", authBasic, true, small, false, 2 * len(small),
+			[]string{"GET", "GET", "POST", "POST"}},
+		{"basic large body", authBasic, true, large, false, 2 * len(large),
+			[]string{"GET", "GET", "POST", "POST"}},
+		// The scheme is remembered by the 407 of the first POST
+		{"basic not negotiated", authBasic, false, small, true, 2 * len(small),
+			[]string{"POST", "POST"}},
+		// NTLM negotiate messages are sent by HEAD requests, the body is
+		// sent with the authenticate message
+		{"ntlm", authNTLM, true, small, false, 2 * len(small),
+			[]string{"GET", "GET", "GET", "HEAD", "POST", "HEAD", "POST"}},
+		{"ntlm large body", authNTLM, true, large, false, 2 * len(large),
+			[]string{"GET", "GET", "GET", "HEAD", "POST", "HEAD", "POST"}},
+		// The POST after the 407 of the first one does the NTLM handshake
+		{"ntlm not negotiated", authNTLM, false, small, true, 2 * len(small),
+			[]string{"POST", "HEAD", "POST"}},
+		// Nothing is probed nor resent if the proxy doesn't require authentication
+		{"no authentication", "", false, small, false, 2 * len(small),
+			[]string{"POST", "POST"}},
+	}
+	for _, tt := range tests {
+		p := &authProxy{scheme: tt.scheme, negotiated: map[string]bool{}}
+		ts := httptest.NewServer(p)
+
+		u, _ := url.Parse(ts.URL)
+		u.User = url.UserPassword("user", "pass")
+		s := &HTTPForwardProxy{}
+		tr := s.newForwardTransport(newHTTPDialer(u, &net.Dialer{}, TunnelConfig{}))
+
+		if tt.get {
+			req, _ := http.NewRequest("GET", "http://example.org/", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s: GET: %s", tt.name, err)
+			}
+			drainBody(resp)
+		}
+
+		// The proxy asks authentication for each request of NTLM
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", "http://example.org/form", ioutil.NopCloser(bytes.NewReader(tt.body)))
+			req.ContentLength = int64(len(tt.body))
+			req.GetBody = nil // like requests of http.Server
+
+			resp, err := tr.RoundTrip(req)
+			if i == 0 && tt.failFirst {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("%s: request %d: succeeded", tt.name, i)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: request %d: %s", tt.name, i, err)
+			}
+			got, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(got, tt.body) {
+				t.Errorf("%s: request %d: got %s with %d bytes", tt.name, i, resp.Status, len(got))
+			}
+		}
+
+		p.lock.Lock()
+		if p.sent != tt.wantSent {
+			t.Errorf("%s: proxy received %d body bytes, want %d", tt.name, p.sent, tt.wantSent)
+		}
+		if !reflect.DeepEqual(p.methods, tt.wantMethods) {
+			t.Errorf("%s: proxy received %v, want %v", tt.name, p.methods, tt.wantMethods)
+		}
+		p.lock.Unlock()
+
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestForwardTransportNTLMConcurrent(t *testing.T) {
+	p := &authProxy{scheme: authNTLM, negotiated: map[string]bool{}}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	u.User = url.UserPassword("user", "pass")
+	d := newHTTPDialer(u, &net.Dialer{}, TunnelConfig{})
+	d.setNegotiated(authNTLM)
+	s := &HTTPForwardProxy{}
+	tr := s.newForwardTransport(d)
+	defer tr.CloseIdleConnections()
+
+	// Each handshake fails if another one takes its connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://example.org/", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			drainBody(resp)
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("got %s", resp.Status)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestHTTPForwardProxyFailover(t *testing.T) {
+	// The port of the closed listener refuses connections
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := "http://" + l.Addr().String()
+	l.Close()
+	auth := httptest.NewServer(&authProxy{scheme: authBasic})
+	defer auth.Close()
+
+	tests := []struct {
+		name      string
+		first     string // URL of the first upstream
+		body      string
+		wantOK    bool
+		wantFirst bool // the first upstream is healthy after the request
+	}{
+		{"refused", refused, "", true, false},
+		{"refused with body", refused, "name=value", true, false},
+		{"407", auth.URL, "", true, false},
+		// The body has been sent to the first upstream
+		{"407 with body", auth.URL, "name=value", false, false},
+	}
+	for _, tt := range tests {
+		p := &authProxy{negotiated: map[string]bool{}}
+		ts := httptest.NewServer(p)
+
+		first, _ := url.Parse(tt.first)
+		second, _ := url.Parse(ts.URL)
+		pool, err := NewUpstreamPool(UpstreamPoolConfig{Upstreams: []UpstreamConfig{
+			{Name: "first", URL: first},
+			{Name: "second", URL: second},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewHTTPForwardProxy(HTTPForwardProxyConfig{Upstreams: pool})
+
+		req, _ := http.NewRequest("POST", "http://example.org/form", nil)
+		if tt.body != "" {
+			req.Body = ioutil.NopCloser(strings.NewReader(tt.body))
+			req.ContentLength = int64(len(tt.body))
+		}
+		resp, err := s.roundTrip(Decision{Action: ActionProxy}, req)
+		if err == nil {
+			got, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(got) != tt.body {
+				t.Errorf("%s: got body %q, want %q", tt.name, got, tt.body)
+			}
+		}
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.wantOK)
+		}
+		if got := pool.Status()[0].Healthy; got != tt.wantFirst {
+			t.Errorf("%s: first upstream healthy %v, want %v", tt.name, got, tt.wantFirst)
+		}
+		if got := pool.selected().Name; got != "second" {
+			t.Errorf("%s: selected %s, want second", tt.name, got)
+		}
+
+		for _, tr := range s.transports {
+			tr.CloseIdleConnections()
+		}
+		ts.Close()
+	}
+}
+
+func TestIsStreaming(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength int64
+		contentType   string
+		want          bool
+	}{
+		{"fixed length", 100, "text/html", false},
+		{"empty", 0, "", false},
+		{"chunked", -1, "application/json", true},
+		{"server-sent events", 100, "text/event-stream; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{ContentLength: tt.contentLength, Header: http.Header{}}
+		if tt.contentType != "" {
+			resp.Header.Set("Content-Type", tt.contentType)
+		}
+		if got := isStreaming(resp); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		size       int
+		resendable bool
+	}{
+		{0, true},
+		{10, true},
+		{11, false},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte("x"), tt.size)
+		req, _ := http.NewRequest("POST", "http://example.org/", ioutil.NopCloser(bytes.NewReader(body)))
+		req, err := bufferBody(req, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (req.GetBody != nil) != tt.resendable {
+			t.Errorf("size %d: resendable %v, want %v", tt.size, req.GetBody != nil, tt.resendable)
+		}
+		if got, _ := ioutil.ReadAll(req.Body); !bytes.Equal(got, body) {
+			t.Errorf("size %d: body %d bytes, want %d", tt.size, len(got), len(body))
+		}
+	}
+}
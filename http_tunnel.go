@@ -1,123 +1,382 @@
-// This file provides a dialer type of "http://" scheme for
+// This file provides dialer types of "http://" and "https://" schemes for
 // golang.org/x/net/proxy package.
 //
-// The dialer type will be automatically registered by init().
+// The dialer types will be automatically registered by init().
+//
+// The dialer of "https://" connects to the upstream HTTP proxy by TLS,
+// which is configured by TunnelConfig.TLS.
 //
 // The dialer requests an upstream HTTP proxy to create a TCP tunnel
-// by CONNECT method.
+// by CONNECT method. It authenticates by Basic, Digest or NTLM scheme
+// which the proxy requests by 407 responses, and remembers the scheme
+// to authenticate without the extra round trip next time.
 
 package transproxy
 
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/proxy"
 )
 
+const (
+	defaultTunnelDialTimeout      = 10 * time.Second
+	defaultTunnelHandshakeTimeout = 10 * time.Second
+
+	// maxAuthRounds limits 407 responses in a tunnel handshake
+	maxAuthRounds = 4
+
+	// max size of 407 response bodies which are drained to keep the connection
+	maxAuthBodySize = 64 * 1024
+)
+
+var errNTLMConnectionClosed = errors.New("The connection was closed in NTLM handshake")
+
+// TunnelConfig configures tunnels through upstream proxies.
+type TunnelConfig struct {
+	// Timeout of connecting to the proxy
+	DialTimeout time.Duration
+
+	// Timeout of the TLS handshake with https:// proxies, and of each
+	// CONNECT request and its response
+	HandshakeTimeout time.Duration
+
+	// TLS configuration of https:// proxies, which verifies the host of
+	// the proxy URL by the system roots if it's nil
+	TLS *tls.Config
+}
+
+// ProxyError is an error response of the upstream proxy to CONNECT.
+type ProxyError struct {
+	Proxy      string // host:port of the proxy
+	Target     string
+	StatusCode int
+	Status     string
+	ProxyAgent string // Proxy-Agent header
+	Err        error  // the cause in the proxy authentication if any
+}
+
+func (e *ProxyError) Error() string {
+	s := fmt.Sprintf("Proxy %s returns %s for %s", e.Proxy, e.Status, e.Target)
+	if e.ProxyAgent != "" {
+		s += " (Proxy-Agent: " + e.ProxyAgent + ")"
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
 func init() {
 	proxy.RegisterDialerType("http", httpDialType)
+	proxy.RegisterDialerType("https", httpDialType)
 }
 
 type httpDialer struct {
-	addr    string
-	header  http.Header
-	forward proxy.Dialer
+	addr             string
+	tls              bool // https:// proxy
+	tlsConfig        *tls.Config
+	user             *url.Userinfo
+	forward          proxy.Dialer
+	handshakeTimeout time.Duration
+	digest           *digestState
+	lock             sync.Mutex
+	scheme           string // negotiated authentication scheme
 }
 
 func httpDialType(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
-	var header http.Header
-	if uu := u.User; uu != nil {
-		passwd, _ := uu.Password()
-		up := uu.Username() + ":" + passwd
-		authz := "Basic " + base64.StdEncoding.EncodeToString([]byte(up))
-		header = map[string][]string{
-			"Proxy-Authorization": {authz},
-		}
+	return newHTTPDialer(u, forward, TunnelConfig{}), nil
+}
+
+func newHTTPDialer(u *url.URL, forward proxy.Dialer, c TunnelConfig) *httpDialer {
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = defaultTunnelHandshakeTimeout
 	}
 	return &httpDialer{
-		addr:    u.Host,
-		header:  header,
-		forward: forward,
-	}, nil
+		addr:             proxyAddr(u),
+		tls:              u.Scheme == "https",
+		tlsConfig:        c.TLS,
+		user:             u.User,
+		forward:          forward,
+		handshakeTimeout: c.HandshakeTimeout,
+		digest:           &digestState{},
+	}
 }
 
-func (d *httpDialer) Dial(network, addr string) (c net.Conn, err error) {
-	req := &http.Request{
-		Method: "CONNECT",
-		URL:    &url.URL{Opaque: addr},
-		Host:   addr,
-		Header: d.header,
+// newProxyDialer returns the dialer through the upstream proxy of the URL.
+func newProxyDialer(u *url.URL, c TunnelConfig) (proxy.Dialer, error) {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultTunnelDialTimeout
+	}
+	forward := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 3 * time.Minute,
+		DualStack: true,
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return newHTTPDialer(u, forward, c), nil
+	default:
+		return proxy.FromURL(u, forward)
 	}
-	c, err = d.forward.Dial("tcp", d.addr)
+}
+
+func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
+	c, code, err := d.dial(addr)
+	if code == 0 {
+		tunnelConnects.With(d.addr, "error").Inc()
+	} else {
+		tunnelConnects.With(d.addr, strconv.Itoa(code)).Inc()
+	}
+	return c, err
+}
+
+// dial creates the tunnel. It returns the status code of the last response,
+// 0 if there is no response.
+func (d *httpDialer) dial(addr string) (net.Conn, int, error) {
+	c, br, err := d.dialProxy()
 	if err != nil {
-		return
-	}
-	req.Write(c)
-
-	// Read response until "\r\n\r\n".
-	// bufio cannot be used as the connected server may not be
-	// a HTTP(S) server.
-	c.SetReadDeadline(time.Now().Add(10 * time.Second))
-	buf := make([]byte, 0, 4096)
-	b := make([]byte, 1)
-	state := 0
-	for {
-		_, e := c.Read(b)
-		if e != nil {
+		return nil, 0, err
+	}
+
+	auth, authz, err := d.newProxyAuth("CONNECT", addr)
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+
+	for round := 0; ; round++ {
+		resp, err := d.connect(c, br, addr, authz)
+		if err != nil {
 			c.Close()
-			return nil, errors.New("reset proxy connection")
+			return nil, 0, err
 		}
-		buf = append(buf, b[0])
-		switch state {
-		case 0:
-			if b[0] == byte('\r') {
-				state++
-			}
-			continue
-		case 1:
-			if b[0] == byte('\n') {
-				state++
-			} else {
-				state = 0
-			}
-			continue
-		case 2:
-			if b[0] == byte('\r') {
-				state++
-			} else {
-				state = 0
+		// Some proxies reply other 2xx than 200 or HTTP/1.0
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			auth.accepted()
+			return tunnelConn(c, br), resp.StatusCode, nil
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || d.user == nil || round >= maxAuthRounds {
+			c.Close()
+			return nil, resp.StatusCode, d.proxyError(resp, addr, nil)
+		}
+
+		var challenge *authChallenge
+		authz, challenge, err = auth.next(resp)
+		if err != nil {
+			c.Close()
+			return nil, resp.StatusCode, d.proxyError(resp, addr, err)
+		}
+
+		if resp.Close || !d.drainBody(c, resp) {
+			// The proxy closes the connection, NTLM can't continue
+			// the handshake on another connection
+			c.Close()
+			if auth.scheme == authNTLM && challenge.Token != "" {
+				return nil, resp.StatusCode, d.proxyError(resp, addr, errNTLMConnectionClosed)
 			}
-			continue
-		case 3:
-			if b[0] == byte('\n') {
-				goto PARSE
-			} else {
-				state = 0
+			if c, br, err = d.dialProxy(); err != nil {
+				return nil, 0, err
 			}
 		}
 	}
+}
 
-PARSE:
-	var zero time.Time
-	c.SetReadDeadline(zero)
-	resp, e := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(buf)), req)
-	if e != nil {
-		c.Close()
-		return nil, e
+func (d *httpDialer) dialProxy() (net.Conn, *bufio.Reader, error) {
+	c, err := d.dialProxyConn()
+	if err != nil {
+		return nil, nil, err
 	}
-	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		c.Close()
-		return nil, fmt.Errorf("proxy returns %s", resp.Status)
+	return c, bufio.NewReader(c), nil
+}
+
+// dialProxyConn connects to the proxy, by TLS if it's an https:// proxy.
+func (d *httpDialer) dialProxyConn() (net.Conn, error) {
+	if d.tls {
+		return dialProxyTLS(d.forward, "tcp", d.addr, d.tlsConfig, d.handshakeTimeout)
+	}
+	return d.forward.Dial("tcp", d.addr)
+}
+
+// connect sends a CONNECT request and reads the response header.
+func (d *httpDialer) connect(c net.Conn, br *bufio.Reader, addr, authz string) (*http.Response, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	// NTLM authenticates the connection, not the request
+	req.Header.Set("Proxy-Connection", "Keep-Alive")
+	if authz != "" {
+		req.Header.Set("Proxy-Authorization", authz)
+	}
+
+	c.SetDeadline(time.Now().Add(d.handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("Can't send CONNECT to proxy %s: %s", d.addr, err)
 	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read CONNECT response from proxy %s: %s", d.addr, err)
+	}
+	return resp, nil
+}
+
+// drainBody reads the body to reuse the connection.
+// It returns false if the body is too large.
+func (d *httpDialer) drainBody(c net.Conn, resp *http.Response) bool {
+	c.SetDeadline(time.Now().Add(d.handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxAuthBodySize+1))
+	return err == nil && n <= maxAuthBodySize
+}
+
+func (d *httpDialer) proxyError(resp *http.Response, addr string, err error) error {
+	return &ProxyError{
+		Proxy:      d.addr,
+		Target:     addr,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		ProxyAgent: resp.Header.Get("Proxy-Agent"),
+		Err:        err,
+	}
+}
+
+// tunnelConn returns the connection of the tunnel. Bytes which the proxy
+// sent after the response header are buffered, e.g. the greeting of SSH
+// servers, so they are replayed before reading from the connection.
+func tunnelConn(c net.Conn, br *bufio.Reader) net.Conn {
+	n := br.Buffered()
+	if n == 0 {
+		return c
+	}
+	early, _ := br.Peek(n)
+	return &replayConn{
+		Conn:   c,
+		peeked: bytes.NewReader(append([]byte(nil), early...)),
+	}
+}
+
+// proxyAuth authenticates requests to the proxy, CONNECT requests of a
+// tunnel handshake or forwarded requests, by the schemes which the proxy
+// requests by 407 responses.
+type proxyAuth struct {
+	d        *httpDialer
+	method   string
+	uri      string // the request target
+	scheme   string
+	session  authSession
+	rejected map[string]bool
+}
+
+// newProxyAuth returns the authentication of requests to the target, and the
+// Proxy-Authorization header of the first request by the negotiated scheme.
+// The header is empty if no scheme has been negotiated.
+func (d *httpDialer) newProxyAuth(method, uri string) (*proxyAuth, string, error) {
+	return d.newProxyAuthScheme(d.negotiated(), method, uri)
+}
+
+// newProxyAuthScheme is like newProxyAuth, but authenticates by the scheme.
+func (d *httpDialer) newProxyAuthScheme(scheme, method, uri string) (*proxyAuth, string, error) {
+	a := &proxyAuth{
+		d:        d,
+		method:   method,
+		uri:      uri,
+		scheme:   scheme,
+		rejected: map[string]bool{},
+	}
+	if a.scheme == "" {
+		return a, "", nil
+	}
+	a.session = d.newSession(a.scheme, method, uri)
+	authz, err := a.session.next(nil)
+	return a, authz, err
+}
+
+// next returns the Proxy-Authorization header to the 407 response and the
+// challenge which it answers. It continues the current scheme, or switches
+// to the most preferred one offered by the proxy which hasn't been rejected.
+func (a *proxyAuth) next(resp *http.Response) (string, *authChallenge, error) {
+	challenges := parseChallenges(resp.Header)
+	challenge := findChallenge(challenges, a.scheme)
+	authz := ""
+	err := errAuthRejected
+	if a.session != nil && challenge != nil {
+		authz, err = a.session.next(challenge)
+	}
+	if err == errAuthRejected {
+		a.rejected[a.scheme] = true
+		if challenge = chooseChallenge(challenges, a.rejected); challenge == nil {
+			return "", nil, errAuthRejected
+		}
+		a.scheme = challenge.Scheme
+		a.session = a.d.newSession(a.scheme, a.method, a.uri)
+		log.Printf("debug: category='HTTP-Tunnel' Authenticate to proxy %s by %s", a.d.addr, a.scheme)
+		authz, err = a.session.next(challenge)
+	}
+	return authz, challenge, err
+}
+
+// negotiating reports whether the last header is an NTLM negotiate message,
+// which the proxy always answers by 407.
+func (a *proxyAuth) negotiating() bool {
+	s, ok := a.session.(*ntlmSession)
+	return ok && s.state == 1
+}
+
+// accepted remembers the scheme to authenticate without the extra round
+// trip next time.
+func (a *proxyAuth) accepted() {
+	if a.scheme != "" {
+		a.d.setNegotiated(a.scheme)
+	}
+}
+
+func (d *httpDialer) newSession(scheme, method, uri string) authSession {
+	username := d.user.Username()
+	password, _ := d.user.Password()
+
+	switch scheme {
+	case authNTLM:
+		return newNTLMSession(username, password)
+	case authDigest:
+		return &digestSession{
+			state:    d.digest,
+			username: username,
+			password: password,
+			method:   method,
+			uri:      uri,
+		}
+	default:
+		return newBasicSession(username, password)
+	}
+}
+
+func (d *httpDialer) negotiated() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.scheme
+}
 
-	return c, nil
+func (d *httpDialer) setNegotiated(scheme string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.scheme = scheme
 }
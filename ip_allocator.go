@@ -0,0 +1,346 @@
+package transproxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrIPPoolExhausted is returned when every address of the synthetic IP pool
+// is leased to a name which is still cached by clients or used by connections.
+var ErrIPPoolExhausted = errors.New("synthetic IP pool exhausted")
+
+// ErrIPLeaseInUse is returned when deleting a lease used by connections.
+var ErrIPLeaseInUse = errors.New("IP lease is used by connections")
+
+// IPAllocator leases synthetic IP addresses to domain names.
+//
+// A lease is kept alive by DNS answers (for the DNS TTL) and by active
+// connections to the leased IP. When the pool is used up, the least recently
+// used lease which is expired and has no active connection is reclaimed.
+// An IP which is still used by a connection is never reassigned.
+type IPAllocator struct {
+	lock     sync.Mutex
+	startIP  uint32
+	endIP    uint32
+	nextFree uint32   // next address which has never been leased
+	released []uint32 // addresses of deleted leases
+	ttl      time.Duration
+
+	byDomain map[string]*ipLease
+	byIP     map[uint32]*ipLease
+	lru      *list.List // front is the most recently used lease
+
+	reclaimed uint64
+	exhausted uint64
+}
+
+type ipLease struct {
+	domain  string
+	ip      uint32
+	expires time.Time
+	conns   int
+	elem    *list.Element
+}
+
+// IPLease is a snapshot of a lease.
+type IPLease struct {
+	Domain      string
+	IP          net.IP
+	Expires     time.Time
+	Connections int
+}
+
+// IPAllocatorStats is a snapshot of the allocator state.
+type IPAllocatorStats struct {
+	Size      uint64 // number of addresses in the pool
+	Leased    uint64 // number of addresses leased to a name
+	Active    uint64 // number of leases used by connections
+	Reclaimed uint64 // number of leases reclaimed for another name
+	Exhausted uint64 // number of allocations failed by pool exhaustion
+}
+
+// NewIPAllocator returns the allocator of the IPv4 addresses from startIP
+// to endIP inclusive.
+func NewIPAllocator(startIP, endIP net.IP, ttl time.Duration) (*IPAllocator, error) {
+	if startIP.To4() == nil || endIP.To4() == nil {
+		return nil, fmt.Errorf("Invalid synthetic IP range, it must be IPv4 addresses: %s - %s", startIP, endIP)
+	}
+	start := ip2int(startIP.To4())
+	end := ip2int(endIP.To4())
+	if start > end {
+		return nil, fmt.Errorf("Invalid synthetic IP range, the start is after the end: %s - %s", startIP, endIP)
+	}
+	if end == math.MaxUint32 {
+		// The cursor of never leased addresses would wrap around
+		return nil, fmt.Errorf("Invalid synthetic IP range, the end must be before 255.255.255.255: %s - %s", startIP, endIP)
+	}
+	return &IPAllocator{
+		startIP:  start,
+		endIP:    end,
+		nextFree: start,
+		ttl:      ttl,
+		byDomain: make(map[string]*ipLease),
+		byIP:     make(map[uint32]*ipLease),
+		lru:      list.New(),
+	}, nil
+}
+
+// Allocate returns the IP leased to the domain, leasing a new one if needed.
+// The lease is renewed for the TTL of the allocator.
+func (a *IPAllocator) Allocate(domain string) (net.IP, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+
+	l, ok := a.byDomain[domain]
+	if ok {
+		a.touch(l, now)
+		return int2ip(l.ip), nil
+	}
+
+	// Skip addresses restored from the mapping store
+	for a.inRange(a.nextFree) && a.byIP[a.nextFree] != nil {
+		a.nextFree++
+	}
+
+	var ip uint32
+	if a.inRange(a.nextFree) {
+		ip = a.nextFree
+		a.nextFree++
+	} else if ip, ok = a.popReleased(); ok {
+		// reuse the address of a deleted lease
+	} else {
+		l := a.reclaimable(now)
+		if l == nil {
+			a.exhausted++
+			log.Printf("error: category='DNS-Proxy' Can't allocate IP for %s, %s (size=%d, exhausted=%d)", domain, ErrIPPoolExhausted, a.size(), a.exhausted)
+			return nil, ErrIPPoolExhausted
+		}
+		log.Printf("debug: category='DNS-Proxy' Reclaimed IP %s from %s for %s", int2ip(l.ip), l.domain, domain)
+		a.remove(l)
+		a.reclaimed++
+		ip = l.ip
+	}
+
+	l = &ipLease{
+		domain: domain,
+		ip:     ip,
+	}
+	l.elem = a.lru.PushFront(l)
+	a.byDomain[domain] = l
+	a.byIP[ip] = l
+	a.touch(l, now)
+
+	return int2ip(ip), nil
+}
+
+// Restore leases the IP to the domain as it was last used at the time.
+// It's used for loading the persisted mapping table, the oldest first.
+func (a *IPAllocator) Restore(domain string, ip net.IP, lastUsed time.Time) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	n := ip2int(ip)
+	if !a.inRange(n) {
+		return false
+	}
+	if l, ok := a.byDomain[domain]; ok {
+		a.remove(l)
+	}
+	if l, ok := a.byIP[n]; ok {
+		a.remove(l)
+	}
+
+	l := &ipLease{
+		domain:  domain,
+		ip:      n,
+		expires: lastUsed.Add(a.ttl),
+	}
+	l.elem = a.lru.PushFront(l)
+	a.byDomain[domain] = l
+	a.byIP[n] = l
+
+	return true
+}
+
+// Lookup returns the IP leased to the domain.
+func (a *IPAllocator) Lookup(domain string) (net.IP, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l, ok := a.byDomain[domain]
+	if !ok {
+		return nil, false
+	}
+	return int2ip(l.ip), true
+}
+
+// ReverseLookup returns the domain which the IP is leased to.
+func (a *IPAllocator) ReverseLookup(ip net.IP) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l, ok := a.byIP[ip2int(ip)]
+	if !ok {
+		return "", false
+	}
+	return l.domain, true
+}
+
+// Acquire returns the domain which the IP is leased to and marks the lease
+// as used by a connection until Release is called.
+func (a *IPAllocator) Acquire(ip net.IP) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l, ok := a.byIP[ip2int(ip)]
+	if !ok {
+		return "", fmt.Errorf("Not found %s in the IP leases", ip)
+	}
+	l.conns++
+	a.touch(l, time.Now())
+	return l.domain, nil
+}
+
+// Release marks that a connection acquired by Acquire is closed.
+func (a *IPAllocator) Release(ip net.IP) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l, ok := a.byIP[ip2int(ip)]
+	if !ok {
+		return
+	}
+	if l.conns > 0 {
+		l.conns--
+	}
+	a.touch(l, time.Now())
+}
+
+// Delete deletes the lease of the domain unless it's used by connections.
+// It returns the IP which was leased.
+func (a *IPAllocator) Delete(domain string) (net.IP, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l, ok := a.byDomain[domain]
+	if !ok {
+		return nil, fmt.Errorf("Not found %s in the IP leases", domain)
+	}
+	if l.conns > 0 {
+		return nil, ErrIPLeaseInUse
+	}
+	a.remove(l)
+	a.released = append(a.released, l.ip)
+	return int2ip(l.ip), nil
+}
+
+// Flush deletes all leases which are not used by connections.
+// It returns the deleted leases.
+func (a *IPAllocator) Flush() []IPLease {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	deleted := []IPLease{}
+	for _, l := range a.byIP {
+		if l.conns > 0 {
+			continue
+		}
+		deleted = append(deleted, l.snapshot())
+		a.remove(l)
+		a.released = append(a.released, l.ip)
+	}
+	return deleted
+}
+
+// Leases returns the snapshot of the leases, the most recently used first.
+func (a *IPAllocator) Leases() []IPLease {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	leases := make([]IPLease, 0, a.lru.Len())
+	for e := a.lru.Front(); e != nil; e = e.Next() {
+		leases = append(leases, e.Value.(*ipLease).snapshot())
+	}
+	return leases
+}
+
+func (a *IPAllocator) Stats() IPAllocatorStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var active uint64
+	for _, l := range a.byIP {
+		if l.conns > 0 {
+			active++
+		}
+	}
+	return IPAllocatorStats{
+		Size:      a.size(),
+		Leased:    uint64(len(a.byIP)),
+		Active:    active,
+		Reclaimed: a.reclaimed,
+		Exhausted: a.exhausted,
+	}
+}
+
+func (a *IPAllocator) inRange(ip uint32) bool {
+	return ip >= a.startIP && ip <= a.endIP
+}
+
+func (a *IPAllocator) size() uint64 {
+	if a.endIP < a.startIP {
+		return 0
+	}
+	return uint64(a.endIP-a.startIP) + 1
+}
+
+func (a *IPAllocator) touch(l *ipLease, now time.Time) {
+	l.expires = now.Add(a.ttl)
+	a.lru.MoveToFront(l.elem)
+}
+
+// reclaimable returns the least recently used lease which can be reassigned.
+func (a *IPAllocator) reclaimable(now time.Time) *ipLease {
+	for e := a.lru.Back(); e != nil; e = e.Prev() {
+		l := e.Value.(*ipLease)
+		if l.conns == 0 && now.After(l.expires) {
+			return l
+		}
+	}
+	return nil
+}
+
+// popReleased returns an address of deleted leases which isn't leased again.
+func (a *IPAllocator) popReleased() (uint32, bool) {
+	for len(a.released) > 0 {
+		ip := a.released[len(a.released)-1]
+		a.released = a.released[:len(a.released)-1]
+		if a.byIP[ip] == nil {
+			return ip, true
+		}
+	}
+	return 0, false
+}
+
+func (a *IPAllocator) remove(l *ipLease) {
+	a.lru.Remove(l.elem)
+	delete(a.byDomain, l.domain)
+	delete(a.byIP, l.ip)
+}
+
+func (l *ipLease) snapshot() IPLease {
+	return IPLease{
+		Domain:      l.domain,
+		IP:          int2ip(l.ip),
+		Expires:     l.expires,
+		Connections: l.conns,
+	}
+}
@@ -0,0 +1,122 @@
+package transproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewIPAllocatorRange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		valid      bool
+	}{
+		{"127.0.1.1", "127.0.1.1", true},
+		{"127.0.1.1", "127.0.255.254", true},
+		{"", "127.0.255.254", false},
+		{"127.0.1.1", "", false},
+		{"fd00::1", "fd00::ff", false},
+		{"127.0.1.2", "127.0.1.1", false},
+		{"255.255.255.0", "255.255.255.254", true},
+		{"255.255.255.0", "255.255.255.255", false},
+		{"255.255.255.255", "255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		a, err := NewIPAllocator(net.ParseIP(tt.start), net.ParseIP(tt.end), time.Minute)
+		if tt.valid && (err != nil || a == nil) {
+			t.Errorf("%s - %s: %s", tt.start, tt.end, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s - %s: accepted", tt.start, tt.end)
+		}
+	}
+}
+
+func TestIPAllocatorReclaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		touch   []string // allocated again after a, b and c
+		acquire []string // used by connections
+		want    string   // domain whose IP is reclaimed for d, empty if exhausted
+	}{
+		{
+			name: "least recently used",
+			want: "a.example.org.",
+		},
+		{
+			name:  "least recently used after renewal",
+			touch: []string{"a.example.org."},
+			want:  "b.example.org.",
+		},
+		{
+			name:    "skip the lease used by connections",
+			acquire: []string{"a.example.org."},
+			want:    "b.example.org.",
+		},
+		{
+			name:    "exhausted by connections",
+			acquire: []string{"a.example.org.", "b.example.org.", "c.example.org."},
+		},
+		{
+			name: "exhausted by unexpired leases",
+			ttl:  time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		// Leases expire immediately unless the TTL is set
+		ttl := tt.ttl
+		if ttl == 0 {
+			ttl = -time.Second
+		}
+		a, err := NewIPAllocator(net.ParseIP("127.0.1.1"), net.ParseIP("127.0.1.3"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ips := map[string]string{}
+		for _, domain := range []string{"a.example.org.", "b.example.org.", "c.example.org."} {
+			ip, err := a.Allocate(domain)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			ips[domain] = ip.String()
+		}
+		for _, domain := range tt.touch {
+			a.Allocate(domain)
+		}
+		for _, domain := range tt.acquire {
+			if _, err := a.Acquire(net.ParseIP(ips[domain])); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+		}
+
+		ip, err := a.Allocate("d.example.org.")
+		if tt.want == "" {
+			if err != ErrIPPoolExhausted {
+				t.Errorf("%s: got %s, %v, want %s", tt.name, ip, err, ErrIPPoolExhausted)
+			}
+			if stats := a.Stats(); stats.Exhausted != 1 || stats.Reclaimed != 0 {
+				t.Errorf("%s: %+v", tt.name, stats)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if ip.String() != ips[tt.want] {
+			t.Errorf("%s: got %s, want %s of %s", tt.name, ip, ips[tt.want], tt.want)
+		}
+		if _, ok := a.Lookup(tt.want); ok {
+			t.Errorf("%s: %s is still leased", tt.name, tt.want)
+		}
+		if domain, _ := a.ReverseLookup(ip); domain != "d.example.org." {
+			t.Errorf("%s: %s is leased to %s", tt.name, ip, domain)
+		}
+		if stats := a.Stats(); stats.Reclaimed != 1 || stats.Leased != 3 {
+			t.Errorf("%s: %+v", tt.name, stats)
+		}
+	}
+}
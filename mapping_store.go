@@ -0,0 +1,315 @@
+package transproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mapping is a lease of a synthetic IP to a domain name.
+type Mapping struct {
+	Domain string    `json:"domain"`
+	IP     string    `json:"ip"`
+	Time   time.Time `json:"time"`
+
+	// Deleted records the deletion of the mapping
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// MappingStore persists the mapping table of DNSProxy across restarts.
+type MappingStore interface {
+	// Load returns the stored mappings, the oldest first.
+	Load() ([]Mapping, error)
+
+	// Save records the mapping. A later mapping for the same IP overrides older ones,
+	// and a deleted mapping drops them.
+	Save(m Mapping) error
+
+	Close() error
+}
+
+const (
+	// mappingRefreshInterval is the minimum interval to record the same mapping again.
+	mappingRefreshInterval = time.Minute
+
+	// mappingCompactThreshold is the number of stale records tolerated in the journal.
+	mappingCompactThreshold = 1024
+
+	// mappingCompactRetryInterval is the interval to retry a failed compaction.
+	mappingCompactRetryInterval = 10 * time.Minute
+)
+
+// FileMappingStore is a MappingStore which appends mappings to a journal file
+// as JSON lines. The journal is compacted on loading, and in the background
+// whenever stale records grow.
+type FileMappingStore struct {
+	path      string
+	retention time.Duration
+
+	lock    sync.Mutex
+	file    *os.File
+	closed  bool
+	live    map[string]Mapping // keyed by IP
+	domains map[string]string  // domain to IP
+	records int
+
+	// Records saved while compacting, which are appended to the compacted journal
+	compacting bool
+	pending    [][]byte
+	retryAt    time.Time // compaction is suspended until the time after a failure
+}
+
+// NewFileMappingStore opens the journal at the path.
+// Mappings which are not used longer than the retention are dropped (0 means forever).
+func NewFileMappingStore(path string, retention time.Duration) (*FileMappingStore, error) {
+	s := &FileMappingStore{
+		path:      path,
+		retention: retention,
+		live:      make(map[string]Mapping),
+		domains:   make(map[string]string),
+	}
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileMappingStore) Load() ([]Mapping, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sorted(), nil
+}
+
+func (s *FileMappingStore) Save(m Mapping) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	if old, ok := s.live[m.IP]; ok && !m.Deleted && old.Domain == m.Domain && m.Time.Sub(old.Time) < mappingRefreshInterval {
+		return nil
+	}
+	s.put(m)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if s.file == nil {
+		// The journal couldn't be reopened after the compaction
+		if s.file, err = openJournal(s.path); err != nil {
+			return err
+		}
+	}
+	if s.compacting {
+		s.pending = append(s.pending, b)
+	}
+	if _, err := s.file.Write(b); err != nil {
+		return err
+	}
+	s.records++
+
+	if !s.compacting && s.records > 2*len(s.live)+mappingCompactThreshold && time.Now().After(s.retryAt) {
+		s.compacting = true
+		go func() {
+			if err := s.compact(); err != nil {
+				log.Printf("warn: category='DNS-Proxy' Can't compact mapping journal %s: %s", s.path, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *FileMappingStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileMappingStore) read() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m Mapping
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			// The last line might be broken by a crash
+			log.Printf("warn: category='DNS-Proxy' Skipped broken record in %s: %s", s.path, err)
+			continue
+		}
+		s.put(m)
+	}
+	return scanner.Err()
+}
+
+func (s *FileMappingStore) put(m Mapping) {
+	if m.Deleted {
+		if old, ok := s.live[m.IP]; ok && old.Domain == m.Domain {
+			delete(s.live, m.IP)
+			delete(s.domains, m.Domain)
+		}
+		return
+	}
+
+	// A domain has only one IP and an IP has only one domain, drop the older ones
+	if ip, ok := s.domains[m.Domain]; ok && ip != m.IP {
+		delete(s.live, ip)
+	}
+	if old, ok := s.live[m.IP]; ok && old.Domain != m.Domain {
+		delete(s.domains, old.Domain)
+	}
+	s.live[m.IP] = m
+	s.domains[m.Domain] = m.IP
+}
+
+// compact rewrites the journal with live mappings only. The journal is
+// written without the lock, and the records saved meanwhile are appended
+// to it. The current journal is kept if it fails, and the compaction is
+// retried after mappingCompactRetryInterval.
+func (s *FileMappingStore) compact() error {
+	s.lock.Lock()
+	s.expire()
+	mappings := s.sorted()
+	s.compacting = true
+	s.pending = nil
+	s.lock.Unlock()
+
+	tmp, err := writeMappings(s.path, mappings)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pending := s.pending
+	s.compacting = false
+	s.pending = nil
+
+	if err != nil {
+		s.retryAt = time.Now().Add(mappingCompactRetryInterval)
+		return err
+	}
+	for _, b := range pending {
+		if _, err = tmp.Write(b); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Windows can't rename over an open file, the journal is
+		// reopened after renamed
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.retryAt = time.Now().Add(mappingCompactRetryInterval)
+	}
+
+	if s.file == nil && !s.closed {
+		file, ferr := openJournal(s.path)
+		if ferr != nil && err == nil {
+			err = ferr
+		}
+		s.file = file
+	}
+	if err != nil {
+		return err
+	}
+	s.records = len(mappings) + len(pending)
+
+	log.Printf("debug: category='DNS-Proxy' Compacted mapping journal %s, %d mappings", s.path, len(s.live))
+
+	return nil
+}
+
+// expire drops mappings which are not used longer than the retention.
+func (s *FileMappingStore) expire() {
+	if s.retention <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.retention)
+	for ip, m := range s.live {
+		if m.Time.Before(deadline) {
+			delete(s.live, ip)
+			delete(s.domains, m.Domain)
+		}
+	}
+}
+
+// writeMappings writes the mappings into a temporary file next to the path,
+// and returns the file opened for appending records.
+func writeMappings(path string, mappings []Mapping) (*os.File, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, m := range mappings {
+		b, err := json.Marshal(m)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// openJournal opens the journal for appending records.
+func openJournal(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// sorted returns live mappings ordered by the time.
+func (s *FileMappingStore) sorted() []Mapping {
+	mappings := make([]Mapping, 0, len(s.live))
+	for _, m := range s.live {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Time.Before(mappings[j].Time)
+	})
+	return mappings
+}
@@ -0,0 +1,211 @@
+package transproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempJournal(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "mapping.json")
+	if content != "" {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func countLines(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func domainsByIP(mappings []Mapping) map[string]string {
+	m := map[string]string{}
+	for _, mapping := range mappings {
+		m[mapping.IP] = mapping.Domain
+	}
+	return m
+}
+
+func TestFileMappingStoreReplay(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339Nano)
+	record := func(domain, ip, ts string, deleted bool) string {
+		s := `{"domain":"` + domain + `","ip":"` + ip + `","time":"` + ts + `"`
+		if deleted {
+			s += `,"deleted":true`
+		}
+		return s + "}\n"
+	}
+
+	tests := []struct {
+		name      string
+		journal   string
+		retention time.Duration
+		want      map[string]string
+	}{
+		{
+			name:    "empty",
+			journal: "",
+			want:    map[string]string{},
+		},
+		{
+			name:    "later mapping of the IP overrides",
+			journal: record("a.example.org.", "127.0.1.1", now, false) + record("b.example.org.", "127.0.1.1", now, false),
+			want:    map[string]string{"127.0.1.1": "b.example.org."},
+		},
+		{
+			name:    "later mapping of the domain overrides",
+			journal: record("a.example.org.", "127.0.1.1", now, false) + record("a.example.org.", "127.0.1.2", now, false),
+			want:    map[string]string{"127.0.1.2": "a.example.org."},
+		},
+		{
+			name:    "deleted mapping drops",
+			journal: record("a.example.org.", "127.0.1.1", now, false) + record("b.example.org.", "127.0.1.2", now, false) + record("a.example.org.", "127.0.1.1", now, true),
+			want:    map[string]string{"127.0.1.2": "b.example.org."},
+		},
+		{
+			name:    "deletion of another domain is ignored",
+			journal: record("a.example.org.", "127.0.1.1", now, false) + record("b.example.org.", "127.0.1.1", now, true),
+			want:    map[string]string{"127.0.1.1": "a.example.org."},
+		},
+		{
+			name:    "broken last line is skipped",
+			journal: record("a.example.org.", "127.0.1.1", now, false) + `{"domain":"b.exa`,
+			want:    map[string]string{"127.0.1.1": "a.example.org."},
+		},
+		{
+			name:      "expired mapping is dropped",
+			journal:   record("a.example.org.", "127.0.1.1", old, false) + record("b.example.org.", "127.0.1.2", now, false),
+			retention: time.Hour,
+			want:      map[string]string{"127.0.1.2": "b.example.org."},
+		},
+	}
+
+	for _, tt := range tests {
+		path := tempJournal(t, tt.journal)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		s, err := NewFileMappingStore(path, tt.retention)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		mappings, _ := s.Load()
+		if got := domainsByIP(mappings); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		s.Close()
+
+		// Compacted on loading
+		if n := countLines(t, path); n != len(tt.want) {
+			t.Errorf("%s: %d records after compaction, want %d", tt.name, n, len(tt.want))
+		}
+	}
+}
+
+func TestFileMappingStoreCompaction(t *testing.T) {
+	path := tempJournal(t, "")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := NewFileMappingStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < mappingCompactThreshold+16; i++ {
+		// Each record is stale after the refresh interval
+		m := Mapping{Domain: "a.example.org.", IP: "127.0.1.1", Time: start.Add(time.Duration(i) * mappingRefreshInterval)}
+		if err := s.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Save(Mapping{Domain: "b.example.org.", IP: "127.0.1.2", Time: start})
+
+	// Wait for the compaction in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.Lock()
+		records, compacting := s.records, s.compacting
+		s.lock.Unlock()
+		if records < mappingCompactThreshold && !compacting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not compacted, %d records", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileMappingStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	mappings, _ := reopened.Load()
+	want := map[string]string{"127.0.1.1": "a.example.org.", "127.0.1.2": "b.example.org."}
+	if got := domainsByIP(mappings); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileMappingStoreCompactionFailure(t *testing.T) {
+	path := tempJournal(t, "")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := NewFileMappingStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The temporary file can't be created in the missing directory
+	s.path = filepath.Join(filepath.Dir(path), "missing", "mapping.json")
+	if err := s.compact(); err == nil {
+		t.Fatal("compacted into the missing directory")
+	}
+	s.path = path
+
+	if err := s.Save(Mapping{Domain: "a.example.org.", IP: "127.0.1.1", Time: time.Now()}); err != nil {
+		t.Fatalf("Save after the failed compaction: %s", err)
+	}
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("%d records, want 1", n)
+	}
+
+	// The compaction isn't retried until the retry interval
+	start := time.Now()
+	for i := 1; i <= mappingCompactThreshold+16; i++ {
+		m := Mapping{Domain: "a.example.org.", IP: "127.0.1.1", Time: start.Add(time.Duration(i) * mappingRefreshInterval)}
+		if err := s.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.lock.Lock()
+	compacting := s.compacting
+	s.lock.Unlock()
+	if compacting {
+		t.Error("compaction retried right after the failure")
+	}
+}
@@ -0,0 +1,319 @@
+package transproxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of the process in Prometheus text format. They are global because
+// dialers are created by golang.org/x/net/proxy without the context.
+var (
+	defaultMetrics = &metricsRegistry{}
+
+	dnsQueries = defaultMetrics.counterVec("transproxy_dns_queries_total",
+		"DNS queries by the type and the route (public, private or blocked).", "qtype", "route")
+	dnsForwardDuration = defaultMetrics.histogramVec("transproxy_dns_forward_duration_seconds",
+		"Latency of DNS servers which queries are forwarded to.", dnsDurationBuckets, "route", "server")
+	dnsForwardFailures = defaultMetrics.counterVec("transproxy_dns_forward_failures_total",
+		"Failed queries to DNS servers which queries are forwarded to.", "route", "server")
+	tunnelConnects = defaultMetrics.counterVec("transproxy_tunnel_connects_total",
+		"CONNECT requests to upstream proxies by the final status code, \"error\" if no response.", "proxy", "code")
+	activeConnections = defaultMetrics.gaugeVec("transproxy_active_connections",
+		"Active relayed connections by the listen port.", "port")
+	relayedBytes = defaultMetrics.counterVec("transproxy_relayed_bytes_total",
+		"Bytes relayed by the listen port and the direction (sent to or received from upstreams).", "port", "direction")
+	clientRejections = defaultMetrics.counterVec("transproxy_client_rejections_total",
+		"Connections and DNS queries rejected by the client ACL by the listener (the port or \"dns\").", "listener")
+)
+
+var dnsDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metric writes its samples in Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+type metricsRegistry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// metricVec is a set of series of a metric keyed by the label values.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func (v *metricVec) with(newSeries func() interface{}, values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values", v.name, len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = newSeries()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each calls the function with the series in the order of the label values.
+func (v *metricVec) each(w io.Writer, f func(labels string, series interface{})) {
+	v.lock.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		series[i] = v.series[k]
+		labels[i] = formatLabels(v.labels, v.values[k])
+	}
+	v.lock.Unlock()
+
+	writeMetricHeader(w, v.name, v.help, v.typ)
+	for i := range keys {
+		f(labels[i], series[i])
+	}
+}
+
+func newMetricVec(name, help, typ string, labels []string) metricVec {
+	return metricVec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: map[string]interface{}{},
+		values: map[string][]string{},
+	}
+}
+
+type counter struct {
+	v int64 // atomic
+}
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *counter) Inc() {
+	c.Add(1)
+}
+
+type counterVec struct {
+	metricVec
+}
+
+func (r *metricsRegistry) counterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{newMetricVec(name, help, "counter", labels)}
+	r.register(v)
+	return v
+}
+
+func (v *counterVec) With(values ...string) *counter {
+	return v.with(func() interface{} { return &counter{} }, values).(*counter)
+}
+
+func (v *counterVec) write(w io.Writer) {
+	v.each(w, func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labels, atomic.LoadInt64(&s.(*counter).v))
+	})
+}
+
+// gaugeVec is a metricVec of integer values which can go down, counter is
+// used as the value.
+type gaugeVec struct {
+	metricVec
+}
+
+func (r *metricsRegistry) gaugeVec(name, help string, labels ...string) *gaugeVec {
+	v := &gaugeVec{newMetricVec(name, help, "gauge", labels)}
+	r.register(v)
+	return v
+}
+
+func (v *gaugeVec) With(values ...string) *counter {
+	return v.with(func() interface{} { return &counter{} }, values).(*counter)
+}
+
+func (v *gaugeVec) write(w io.Writer) {
+	v.each(w, func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labels, atomic.LoadInt64(&s.(*counter).v))
+	})
+}
+
+type histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64 // not cumulative
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+func (r *metricsRegistry) histogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	v := &histogramVec{newMetricVec(name, help, "histogram", labels), buckets}
+	r.register(v)
+	return v
+}
+
+func (v *histogramVec) With(values ...string) *histogram {
+	return v.with(func() interface{} {
+		return &histogram{
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+	}, values).(*histogram)
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	v.each(w, func(labels string, s interface{}) {
+		h := s.(*histogram)
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, withLabel(labels, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, withLabel(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, h.count)
+	})
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeGauge writes a gauge without labels which is collected on scrape.
+func writeGauge(w io.Writer, name, help string, v float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	writeMetricHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + labelValueReplacer.Replace(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteMetrics writes the metrics in Prometheus text format.
+func (s *Transproxy) WriteMetrics(w io.Writer) {
+	defaultMetrics.write(w)
+
+	stats := s.dnsProxy.AllocatorStats()
+	writeGauge(w, "transproxy_ip_pool_size", "Addresses in the synthetic IP pool.", float64(stats.Size))
+	writeGauge(w, "transproxy_ip_pool_leased", "Addresses leased to names.", float64(stats.Leased))
+	writeGauge(w, "transproxy_ip_pool_active", "Leases used by connections.", float64(stats.Active))
+	writeCounter(w, "transproxy_ip_pool_reclaimed_total", "Leases reclaimed for another name.", float64(stats.Reclaimed))
+	writeCounter(w, "transproxy_ip_pool_exhausted_total", "Allocations failed by pool exhaustion.", float64(stats.Exhausted))
+
+	writeMetricHeader(w, "transproxy_upstream_up", "Health of upstream proxies, 1 if healthy.", "gauge")
+	for _, u := range s.upstreams.Status() {
+		up := 0
+		if u.Healthy {
+			up = 1
+		}
+		fmt.Fprintf(w, "transproxy_upstream_up%s %d\n", formatLabels([]string{"upstream"}, []string{u.Name}), up)
+	}
+}
+
+// MetricsHandler serves the metrics in Prometheus text format.
+func (s *Transproxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
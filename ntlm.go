@@ -0,0 +1,224 @@
+package transproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM message flags
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity |
+		ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+)
+
+const ntlmAvTimestamp = 7
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmSession authenticates by NTLMv2. The messages must be exchanged
+// on the same connection.
+type ntlmSession struct {
+	domain   string
+	username string
+	password string
+	state    int // 0: initial, 1: negotiate sent, 2: authenticate sent
+}
+
+// newNTLMSession returns a session for the user, which is DOMAIN\user or user.
+func newNTLMSession(user, password string) *ntlmSession {
+	s := &ntlmSession{username: user, password: password}
+	if i := strings.IndexByte(user, '\\'); i >= 0 {
+		s.domain = user[:i]
+		s.username = user[i+1:]
+	}
+	return s
+}
+
+func (s *ntlmSession) next(challenge *authChallenge) (string, error) {
+	switch {
+	case s.state == 0:
+		s.state = 1
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+
+	case s.state == 1 && challenge != nil && challenge.Token != "":
+		msg, err := base64.StdEncoding.DecodeString(challenge.Token)
+		if err != nil {
+			return "", err
+		}
+		auth, err := s.authenticateMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		s.state = 2
+		return "NTLM " + base64.StdEncoding.EncodeToString(auth), nil
+
+	default:
+		return "", errAuthRejected
+	}
+}
+
+func ntlmNegotiateMessage() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateFlags)
+	// empty domain and workstation
+	return b
+}
+
+// authenticateMessage answers the challenge message.
+func (s *ntlmSession) authenticateMessage(challenge []byte) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("Invalid NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+	var targetInfo []byte
+	if len(challenge) >= 48 {
+		targetInfo = ntlmPayload(challenge, 40)
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp, hasTimestamp := ntlmTimestamp(targetInfo)
+	if !hasTimestamp {
+		timestamp = make([]byte, 8)
+		// FILETIME, 100ns since 1601-01-01
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	responseKey := ntlmResponseKey(s.username, s.domain, s.password)
+	ntResponse, lmResponse := ntlmV2Response(responseKey, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if hasTimestamp {
+		// MS-NLMP: LMv2 is omitted if the server sends the timestamp
+		lmResponse = make([]byte, 24)
+	}
+
+	unicode := flags&ntlmNegotiateUnicode != 0
+	encode := func(s string) []byte {
+		if unicode {
+			return ntlmUnicode(s)
+		}
+		return []byte(s)
+	}
+
+	payloads := [][]byte{
+		lmResponse,
+		ntResponse,
+		encode(s.domain),
+		encode(s.username),
+		encode(""), // workstation
+		nil,        // session key
+	}
+
+	const headerLen = 64
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	offset := headerLen
+	for i, p := range payloads {
+		field := b[12+i*8:]
+		binary.LittleEndian.PutUint16(field, uint16(len(p)))
+		binary.LittleEndian.PutUint16(field[2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(field[4:], uint32(offset))
+		offset += len(p)
+	}
+	binary.LittleEndian.PutUint32(b[60:], flags&ntlmNegotiateFlags)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b, nil
+}
+
+// ntlmResponseKey returns NTOWFv2 of the user.
+func ntlmResponseKey(username, domain, password string) []byte {
+	h := md4.New()
+	h.Write(ntlmUnicode(password))
+	return ntlmHMAC(h.Sum(nil), ntlmUnicode(strings.ToUpper(username)+domain))
+}
+
+// ntlmV2Response returns NTLMv2 and LMv2 responses to the server challenge.
+func ntlmV2Response(responseKey, serverChallenge, clientChallenge, timestamp, targetInfo []byte) ([]byte, []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	ntProof := ntlmHMAC(responseKey, serverChallenge, temp)
+	ntResponse := append(ntProof, temp...)
+	lmResponse := append(ntlmHMAC(responseKey, serverChallenge, clientChallenge), clientChallenge...)
+	return ntResponse, lmResponse
+}
+
+// ntlmPayload returns the payload of the security buffer at the offset.
+func ntlmPayload(msg []byte, field int) []byte {
+	length := int(binary.LittleEndian.Uint16(msg[field:]))
+	offset := int(binary.LittleEndian.Uint32(msg[field+4:]))
+	if length == 0 || offset+length > len(msg) {
+		return nil
+	}
+	return msg[offset : offset+length]
+}
+
+// ntlmTimestamp returns MsvAvTimestamp of the target info.
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for b := targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		length := int(binary.LittleEndian.Uint16(b[2:]))
+		if len(b) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return b[4:12], true
+		}
+		if id == 0 {
+			break
+		}
+		b = b[4+length:]
+	}
+	return nil, false
+}
+
+func ntlmUnicode(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+func ntlmHMAC(key []byte, data ...[]byte) []byte {
+	m := hmac.New(md5.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
@@ -0,0 +1,139 @@
+package transproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of MS-NLMP 4.2.4 NTLMv2 Authentication
+var (
+	ntlmTestServerChallenge = mustHex("0123456789abcdef")
+	ntlmTestClientChallenge = mustHex("aaaaaaaaaaaaaaaa")
+	ntlmTestTimestamp       = mustHex("0000000000000000")
+	ntlmTestTargetInfo      = mustHex("02000c0044006f006d00610069006e00" + "01000c0053006500720076006500720000000000")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestNTLMResponseKey(t *testing.T) {
+	tests := []struct {
+		user, domain, password string
+		want                   string
+	}{
+		// MS-NLMP 4.2.4.1.1
+		{"User", "Domain", "Password", "0c868a403bfd7a93a3001ef22ef02e3f"},
+		// The user name is case insensitive, the domain isn't
+		{"USER", "Domain", "Password", "0c868a403bfd7a93a3001ef22ef02e3f"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(ntlmResponseKey(tt.user, tt.domain, tt.password)); got != tt.want {
+			t.Errorf("%s\\%s: got %s, want %s", tt.domain, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestNTLMV2Response(t *testing.T) {
+	key := ntlmResponseKey("User", "Domain", "Password")
+	nt, lm := ntlmV2Response(key, ntlmTestServerChallenge, ntlmTestClientChallenge, ntlmTestTimestamp, ntlmTestTargetInfo)
+
+	// MS-NLMP 4.2.4.2.1
+	if want := "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"; hex.EncodeToString(lm) != want {
+		t.Errorf("LMv2 response: got %x, want %s", lm, want)
+	}
+	// MS-NLMP 4.2.4.2.2, NTProofStr
+	if want := "68cd0ab851e51c96aabc927bebef6a1c"; hex.EncodeToString(nt[:16]) != want {
+		t.Errorf("NTProofStr: got %x, want %s", nt[:16], want)
+	}
+	temp := nt[16:]
+	if !bytes.Equal(temp[16:24], ntlmTestClientChallenge) || !bytes.Equal(temp[28:28+len(ntlmTestTargetInfo)], ntlmTestTargetInfo) {
+		t.Errorf("temp: %x", temp)
+	}
+}
+
+// ntlmTestChallenge returns the challenge message of MS-NLMP 4.2.4.3 with
+// the target info.
+func ntlmTestChallenge(targetInfo []byte) *authChallenge {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateFlags)
+	copy(msg[24:], ntlmTestServerChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	msg = append(msg, targetInfo...)
+	return &authChallenge{Scheme: authNTLM, Token: base64.StdEncoding.EncodeToString(msg)}
+}
+
+func TestNTLMSession(t *testing.T) {
+	timestamp := mustHex("0102030405060708")
+	withTimestamp := append(mustHex("07000800"), timestamp...)
+	withTimestamp = append(withTimestamp, ntlmTestTargetInfo...)
+
+	tests := []struct {
+		name       string
+		targetInfo []byte
+		timestamp  []byte // in the response, any if it's nil
+		zeroLM     bool
+	}{
+		{"without timestamp", ntlmTestTargetInfo, nil, false},
+		{"with timestamp", withTimestamp, timestamp, true},
+	}
+	for _, tt := range tests {
+		s := newNTLMSession(`Domain\User`, "Password")
+		negotiate, err := s.next(nil)
+		if err != nil || negotiate != "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+			t.Fatalf("%s: negotiate %q, %v", tt.name, negotiate, err)
+		}
+
+		authenticate, err := s.next(ntlmTestChallenge(tt.targetInfo))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		msg, err := base64.StdEncoding.DecodeString(authenticate[len("NTLM "):])
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+			t.Fatalf("%s: not an authenticate message: %x", tt.name, msg)
+		}
+
+		lm := ntlmPayload(msg, 12)
+		nt := ntlmPayload(msg, 20)
+		if !bytes.Equal(ntlmPayload(msg, 28), ntlmUnicode("Domain")) || !bytes.Equal(ntlmPayload(msg, 36), ntlmUnicode("User")) {
+			t.Errorf("%s: domain %x, user %x", tt.name, ntlmPayload(msg, 28), ntlmPayload(msg, 36))
+		}
+
+		// Verify the proof by the client challenge and the timestamp in the response
+		temp := nt[16:]
+		clientChallenge := temp[16:24]
+		key := ntlmResponseKey("User", "Domain", "Password")
+		want, wantLM := ntlmV2Response(key, ntlmTestServerChallenge, clientChallenge, temp[8:16], tt.targetInfo)
+		if !bytes.Equal(nt, want) {
+			t.Errorf("%s: NTLMv2 response %x, want %x", tt.name, nt, want)
+		}
+		if tt.timestamp != nil && !bytes.Equal(temp[8:16], tt.timestamp) {
+			t.Errorf("%s: timestamp %x, want %x", tt.name, temp[8:16], tt.timestamp)
+		}
+		if tt.zeroLM {
+			wantLM = make([]byte, 24)
+		}
+		if !bytes.Equal(lm, wantLM) {
+			t.Errorf("%s: LMv2 response %x, want %x", tt.name, lm, wantLM)
+		}
+
+		// The handshake is over
+		if _, err := s.next(ntlmTestChallenge(tt.targetInfo)); err != errAuthRejected {
+			t.Errorf("%s: got %v after authenticate, want %v", tt.name, err, errAuthRejected)
+		}
+	}
+}
@@ -1,30 +1,50 @@
 package transproxy
 
 import (
-	"io"
+	"context"
 	"log"
 	"net"
-	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/net/proxy"
 )
 
 type PassThroughProxy struct {
 	PassThroughProxyConfig
+	dialer  *routeDialer
+	tracker *connTracker
+
+	lock     sync.Mutex
+	listener net.Listener
+	stopped  chan struct{} // closed when stopping
+	done     chan struct{} // closed when stopped
 }
 
 type PassThroughProxyConfig struct {
 	ListenAddress string
-	ProxyURL      *url.URL
+	Upstreams     *UpstreamPool
 	DNSProxy      *DNSProxy
+	Sniff         string // SniffTLS, SniffHTTP or SniffNone
+	HostPolicy    string // HostPolicyPreferMapping, HostPolicyPreferSNI or HostPolicyReject
+	Rules         *Rules
+
+	// Clients allowed to connect, all clients if it's nil
+	ACL *ClientACL
+
+	// Timeouts of relays between clients and upstreams
+	Relay RelayConfig
+
+	// Active connections are waited for the period on Stop, then force closed
+	ShutdownGracePeriod time.Duration
 }
 
 func NewPassThroughProxy(c PassThroughProxyConfig) *PassThroughProxy {
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
 	return &PassThroughProxy{
 		PassThroughProxyConfig: c,
+		tracker:                newConnTracker(),
 	}
 }
 
@@ -33,23 +53,29 @@ func (s *PassThroughProxy) GetType() string {
 }
 
 func (s *PassThroughProxy) GetListenPort() int {
-	array := strings.Split(s.ListenAddress, ":")
-	i, _ := strconv.Atoi(array[1])
+	_, port, _ := net.SplitHostPort(s.ListenAddress)
+	i, _ := strconv.Atoi(port)
 	return i
 }
 
-func (s *PassThroughProxy) Start() error {
-	//pdialer := proxy.FromEnvironment()
+// Connections returns the active connections.
+func (s *PassThroughProxy) Connections() []ConnInfo {
+	return s.tracker.list(s.GetType())
+}
 
-	dialer := &net.Dialer{
-		KeepAlive: 3 * time.Minute,
-		DualStack: true,
-	}
+// CloseConnection force closes the connection of the ID.
+func (s *PassThroughProxy) CloseConnection(id uint64) bool {
+	return s.tracker.closeConn(id)
+}
 
-	pdialer, err := proxy.FromURL(s.ProxyURL, dialer)
-	if err != nil {
-		return err
-	}
+func (s *PassThroughProxy) Start() error {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts the listener. The proxy is stopped gracefully when
+// the context is done.
+func (s *PassThroughProxy) StartContext(ctx context.Context) error {
+	s.dialer = newRouteDialer(s.Upstreams, s.DNSProxy)
 
 	log.Printf("info: Start listener on %s category='%s'", s.ListenAddress, s.GetType())
 
@@ -57,52 +83,153 @@ func (s *PassThroughProxy) Start() error {
 	if err != nil {
 		return err
 	}
+	l = newACLListener(l, s.ACL, s.GetType(), s.GetListenPort())
+
+	stopped := make(chan struct{})
+	s.lock.Lock()
+	s.listener = l
+	s.stopped = stopped
+	s.done = make(chan struct{})
+	s.lock.Unlock()
+	s.tracker.reset()
 
 	go func() {
 		for {
 			conn, err := l.Accept() // wait here
 			if err != nil {
-				log.Printf("warn: category='%s' Error accepting new connection - %s", s.GetType(), err.Error())
+				select {
+				case <-stopped:
+				default:
+					log.Printf("warn: category='%s' Error accepting new connection - %s", s.GetType(), err.Error())
+				}
 				return
 			}
 
 			log.Printf("debug: category='%s' Accepted new connection", s.GetType())
 
-			go func(conn net.Conn) {
-				// access logging
-				localAddr := conn.LocalAddr().String()
-				localHost, localPort, _ := net.SplitHostPort(localAddr)
-				remoteAddr := conn.RemoteAddr().String()
-
-				hostName, err := s.DNSProxy.ReverseLookup(localHost)
-				if err != nil {
-					log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' Can't resolve localAddr", s.GetType(), remoteAddr, localAddr)
-					conn.Close()
-					return
-				}
-				log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' resolvedHostName='%s'", s.GetType(), remoteAddr, localAddr, hostName)
-
-				destConn, err := pdialer.Dial("tcp", hostName+":"+localPort)
-				if err != nil {
-					log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Can't connect: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, err.Error())
-					conn.Close()
-					return
-				}
+			tc, ok := s.tracker.open(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			go s.handleConn(conn, tc)
+		}
+	}()
 
-				go transfer(destConn, conn)
-				go transfer(conn, destConn)
-			}(conn)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-stopped:
 		}
 	}()
 
 	return nil
 }
 
+func (s *PassThroughProxy) handleConn(conn net.Conn, tc *trackedConn) {
+	defer s.tracker.close(tc)
+
+	// access logging
+	localAddr := conn.LocalAddr().String()
+	localHost, localPort, _ := net.SplitHostPort(localAddr)
+	remoteAddr := conn.RemoteAddr().String()
+
+	active := activeConnections.With(localPort)
+	active.Inc()
+	defer active.Add(-1)
+
+	// Keep the IP lease while the connection is alive
+	mappedHostName, err := s.DNSProxy.AcquireIP(localHost)
+	if err == nil {
+		defer s.DNSProxy.ReleaseIP(localHost)
+	}
+
+	// Recover the host name from the client stream, it's needed when the mapping
+	// was lost by restart or eviction
+	var sniffedHostName string
+	if s.Sniff != SniffNone {
+		sniffedHostName, conn, err = sniffHost(conn, s.Sniff)
+		if err != nil {
+			log.Printf("debug: category='%s' remoteAddr='%s' localAddr='%s' Can't sniff host name by %s: %s", s.GetType(), remoteAddr, localAddr, s.Sniff, err)
+		}
+	}
+
+	hostName, err := chooseHost(mappedHostName, sniffedHostName, s.HostPolicy)
+	if err != nil {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' Can't resolve localAddr: %s", s.GetType(), remoteAddr, localAddr, err)
+		conn.Close()
+		return
+	}
+	log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' resolvedHostName='%s' mappedHostName='%s' sniffedHostName='%s'", s.GetType(), remoteAddr, localAddr, hostName, mappedHostName, sniffedHostName)
+
+	port, _ := strconv.Atoi(localPort)
+	d := s.Rules.Match(hostName, port)
+	if d.Action == ActionBlock {
+		log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Blocked by rule: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, d.Rule)
+		conn.Close()
+		return
+	}
+	log.Printf("debug: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' action='%s' rule='%s'", s.GetType(), remoteAddr, localAddr, hostName, localPort, d.Action, d.Rule)
+
+	destConn, err := s.dialer.Dial(d, "tcp", hostName+":"+localPort)
+	if err != nil {
+		log.Printf("error: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Can't connect: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, err.Error())
+		conn.Close()
+		return
+	}
+	r := newRelay(s.Relay, conn, destConn)
+	r.countBytes(relayedBytes.With(localPort, "sent"), relayedBytes.With(localPort, "received"))
+	if !s.tracker.setUpstream(tc, hostName+":"+localPort, destConn, r) {
+		destConn.Close()
+		conn.Close()
+		return
+	}
+
+	stats := r.Run()
+	log.Printf("info: category='%s' remoteAddr='%s' localAddr='%s' hostName='%s:%s' Closed, sent: %d, received: %d, duration: %s, reason: %s", s.GetType(), remoteAddr, localAddr, hostName, localPort, stats.Sent, stats.Received, stats.Duration, stats.Reason)
+}
+
+// Stop stops the proxy gracefully in the grace period.
 func (s *PassThroughProxy) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+	defer cancel()
+	s.StopContext(ctx)
 }
 
-func transfer(destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	io.Copy(destination, source)
+// StopContext stops accepting new connections and waits for the active ones
+// until the context is done, then force closes them. It returns after all
+// connections are closed, with the context error if they were force closed.
+func (s *PassThroughProxy) StopContext(ctx context.Context) error {
+	s.lock.Lock()
+	l := s.listener
+	done := s.done
+	s.listener = nil
+	if l != nil {
+		close(s.stopped)
+	}
+	s.lock.Unlock()
+
+	if l == nil {
+		// already stopped or stopping by another call
+		if done == nil {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(done)
+
+	l.Close()
+	log.Printf("info: category='%s' Stopped listener on %s, draining connections", s.GetType(), s.ListenAddress)
+
+	if n := s.tracker.shutdown(ctx); n > 0 {
+		log.Printf("warn: category='%s' Force closed %d connections after the grace period", s.GetType(), n)
+		return ctx.Err()
+	}
+	return nil
 }
@@ -0,0 +1,325 @@
+package transproxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication schemes of upstream HTTP proxies, in lower case.
+const (
+	authBasic  = "basic"
+	authDigest = "digest"
+	authNTLM   = "ntlm"
+)
+
+// authSchemePreference is the order to choose one of the offered schemes.
+var authSchemePreference = []string{authNTLM, authDigest, authBasic}
+
+// authChallenge is a challenge of Proxy-Authenticate header.
+type authChallenge struct {
+	Scheme string            // lower case
+	Token  string            // token68, e.g. the NTLM message
+	Params map[string]string // auth-params with lower case keys
+}
+
+// authSession builds Proxy-Authorization headers of CONNECT requests
+// in a tunnel handshake, or of forwarded requests.
+type authSession interface {
+	// next returns the Proxy-Authorization header for the next request.
+	// The challenge is nil for the first request, otherwise it's the one of
+	// the previous 407 response. It returns an error if the credentials
+	// have been rejected.
+	next(challenge *authChallenge) (string, error)
+}
+
+var errAuthRejected = errors.New("Proxy authentication rejected")
+
+// parseChallenges parses Proxy-Authenticate headers.
+func parseChallenges(header http.Header) []*authChallenge {
+	challenges := []*authChallenge{}
+	for _, v := range header["Proxy-Authenticate"] {
+		var cur *authChallenge
+		for s := v; ; {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			var tok string
+			tok, s = authToken(s)
+			if tok == "" {
+				// malformed, skip to the next element
+				i := strings.IndexByte(s, ',')
+				if i < 0 {
+					break
+				}
+				s = s[i+1:]
+				continue
+			}
+
+			rest := strings.TrimLeft(s, " \t")
+			if cur != nil && strings.HasPrefix(rest, "=") {
+				var val string
+				val, s = authParamValue(strings.TrimLeft(rest[1:], " \t"))
+				cur.Params[strings.ToLower(tok)] = val
+				continue
+			}
+
+			cur = &authChallenge{
+				Scheme: strings.ToLower(tok),
+				Params: map[string]string{},
+			}
+			challenges = append(challenges, cur)
+			s = rest
+
+			// token68 follows the scheme instead of auth-params
+			if t, r := authToken68(s); t != "" {
+				if r = strings.TrimLeft(r, " \t"); r == "" || r[0] == ',' {
+					cur.Token = t
+					s = r
+				}
+			}
+		}
+	}
+	return challenges
+}
+
+func authToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && strings.IndexByte(" \t,=\"", s[i]) < 0 {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func authToken68(s string) (string, string) {
+	i := 0
+	for i < len(s) && strings.IndexByte(" \t,=\"", s[i]) < 0 {
+		i++
+	}
+	if i == 0 {
+		return "", s
+	}
+	for i < len(s) && s[i] == '=' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func authParamValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return authToken(s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// chooseChallenge returns the most preferred challenge of supported schemes
+// except the excluded ones.
+func chooseChallenge(challenges []*authChallenge, exclude map[string]bool) *authChallenge {
+	for _, scheme := range authSchemePreference {
+		if exclude[scheme] {
+			continue
+		}
+		if ch := findChallenge(challenges, scheme); ch != nil {
+			return ch
+		}
+	}
+	return nil
+}
+
+func findChallenge(challenges []*authChallenge, scheme string) *authChallenge {
+	for _, ch := range challenges {
+		if ch.Scheme == scheme {
+			return ch
+		}
+	}
+	return nil
+}
+
+// basicSession sends the credentials in Basic scheme.
+type basicSession struct {
+	authz string
+	sent  bool
+}
+
+func newBasicSession(username, password string) *basicSession {
+	return &basicSession{
+		authz: "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+	}
+}
+
+func (s *basicSession) next(challenge *authChallenge) (string, error) {
+	if challenge != nil && s.sent {
+		return "", errAuthRejected
+	}
+	s.sent = true
+	return s.authz, nil
+}
+
+// digestState is the Digest challenge shared by tunnels to the same proxy,
+// which allows to authenticate without the 407 round trip until the nonce expires.
+type digestState struct {
+	lock      sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	nc        uint32
+}
+
+func (st *digestState) update(challenge *authChallenge) error {
+	algorithm := challenge.Params["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+	default:
+		return fmt.Errorf("Unsupported digest algorithm: %s", algorithm)
+	}
+
+	qop := ""
+	if v, ok := challenge.Params["qop"]; ok {
+		for _, q := range strings.Split(v, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return fmt.Errorf("Unsupported digest qop: %s", v)
+		}
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.realm = challenge.Params["realm"]
+	st.nonce = challenge.Params["nonce"]
+	st.opaque = challenge.Params["opaque"]
+	st.algorithm = algorithm
+	st.qop = qop
+	st.nc = 0
+	return nil
+}
+
+// digestSession sends the credentials in Digest scheme.
+type digestSession struct {
+	state    *digestState
+	username string
+	password string
+	method   string
+	uri      string
+	sentWith string // nonce of the last sent header
+}
+
+func (s *digestSession) next(challenge *authChallenge) (string, error) {
+	if challenge != nil {
+		stale := strings.EqualFold(challenge.Params["stale"], "true")
+		if s.sentWith != "" && !stale && challenge.Params["nonce"] == s.sentWith {
+			return "", errAuthRejected
+		}
+		if err := s.state.update(challenge); err != nil {
+			return "", err
+		}
+	}
+	return s.authorize()
+}
+
+func (s *digestSession) authorize() (string, error) {
+	st := s.state
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.nonce == "" {
+		// no challenge yet, the proxy will send one
+		return "", nil
+	}
+
+	st.nc++
+	nc := fmt.Sprintf("%08x", st.nc)
+	cnonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	response := s.response(nc, cnonce)
+
+	params := []string{
+		"username=" + quoteAuthParam(s.username),
+		"realm=" + quoteAuthParam(st.realm),
+		"nonce=" + quoteAuthParam(st.nonce),
+		"uri=" + quoteAuthParam(s.uri),
+		"response=" + quoteAuthParam(response),
+	}
+	if st.algorithm != "" {
+		params = append(params, "algorithm="+st.algorithm)
+	}
+	if st.opaque != "" {
+		params = append(params, "opaque="+quoteAuthParam(st.opaque))
+	}
+	if st.qop != "" {
+		params = append(params, "qop="+st.qop, "nc="+nc, "cnonce="+quoteAuthParam(cnonce))
+	}
+
+	s.sentWith = st.nonce
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+// response calculates the request-digest of RFC 2617 or RFC 7616.
+// The lock of the state must be held.
+func (s *digestSession) response(nc, cnonce string) string {
+	st := s.state
+	algorithm := strings.ToUpper(st.algorithm)
+	var h func() hash.Hash = md5.New
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		h = sha256.New
+	}
+	digest := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := digest(s.username + ":" + st.realm + ":" + s.password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1 + ":" + st.nonce + ":" + cnonce)
+	}
+	ha2 := digest(s.method + ":" + s.uri)
+
+	if st.qop != "" {
+		return digest(strings.Join([]string{ha1, st.nonce, nc, cnonce, st.qop, ha2}, ":"))
+	}
+	return digest(ha1 + ":" + st.nonce + ":" + ha2)
+}
+
+func quoteAuthParam(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,200 @@
+package transproxy
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   []*authChallenge
+	}{
+		{
+			[]string{`Basic realm="proxy"`},
+			[]*authChallenge{{Scheme: authBasic, Params: map[string]string{"realm": "proxy"}}},
+		},
+		{
+			[]string{`Basic realm="a, b", Digest realm="r\"x", nonce="n1", qop="auth,auth-int", stale=FALSE`},
+			[]*authChallenge{
+				{Scheme: authBasic, Params: map[string]string{"realm": "a, b"}},
+				{Scheme: authDigest, Params: map[string]string{"realm": `r"x`, "nonce": "n1", "qop": "auth,auth-int", "stale": "FALSE"}},
+			},
+		},
+		{
+			[]string{"NTLM", "Negotiate", "NTLM TlRMTVNTUAACAAAA=="},
+			[]*authChallenge{
+				{Scheme: authNTLM, Params: map[string]string{}},
+				{Scheme: "negotiate", Params: map[string]string{}},
+				{Scheme: authNTLM, Token: "TlRMTVNTUAACAAAA==", Params: map[string]string{}},
+			},
+		},
+		{
+			[]string{`, , Basic REALM=proxy`},
+			[]*authChallenge{{Scheme: authBasic, Params: map[string]string{"realm": "proxy"}}},
+		},
+	}
+	for _, tt := range tests {
+		got := parseChallenges(http.Header{"Proxy-Authenticate": tt.header})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %s, want %s", tt.header, challengesString(got), challengesString(tt.want))
+		}
+	}
+}
+
+func challengesString(challenges []*authChallenge) string {
+	s := []string{}
+	for _, c := range challenges {
+		s = append(s, fmt.Sprintf("%+v", *c))
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestChooseChallenge(t *testing.T) {
+	challenges := parseChallenges(http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`, "Negotiate", `Digest realm="proxy", nonce="n"`, "NTLM"}})
+	tests := []struct {
+		rejected map[string]bool
+		want     string
+	}{
+		{map[string]bool{}, authNTLM},
+		{map[string]bool{authNTLM: true}, authDigest},
+		{map[string]bool{authNTLM: true, authDigest: true}, authBasic},
+		{map[string]bool{authNTLM: true, authDigest: true, authBasic: true}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if c := chooseChallenge(challenges, tt.rejected); c != nil {
+			got = c.Scheme
+		}
+		if got != tt.want {
+			t.Errorf("rejected %v: got %q, want %q", tt.rejected, got, tt.want)
+		}
+	}
+}
+
+func TestDigestResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		username  string
+		password  string
+		realm     string
+		nonce     string
+		cnonce    string
+		want      string
+	}{
+		{
+			// RFC 2617 3.5
+			name:     "RFC 2617",
+			username: "Mufasa",
+			password: "Circle Of Life",
+			realm:    "testrealm@host.com",
+			nonce:    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+			cnonce:   "0a4f113b",
+			want:     "6629fae49393a05397450978507c4ef1",
+		},
+		{
+			// RFC 7616 3.9.1, corrected by the erratum
+			name:      "RFC 7616 MD5",
+			algorithm: "MD5",
+			username:  "Mufasa",
+			password:  "Circle of Life",
+			realm:     "http-auth@example.org",
+			nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			want:      "8ca523f5e9506fed4657c9700eebdbec",
+		},
+		{
+			// RFC 7616 3.9.1
+			name:      "RFC 7616 SHA-256",
+			algorithm: "SHA-256",
+			username:  "Mufasa",
+			password:  "Circle of Life",
+			realm:     "http-auth@example.org",
+			nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			want:      "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+	}
+	for _, tt := range tests {
+		s := &digestSession{
+			state: &digestState{
+				realm:     tt.realm,
+				nonce:     tt.nonce,
+				algorithm: tt.algorithm,
+				qop:       "auth",
+			},
+			username: tt.username,
+			password: tt.password,
+			method:   "GET",
+			uri:      "/dir/index.html",
+		}
+		if got := s.response("00000001", tt.cnonce); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDigestSession(t *testing.T) {
+	challenge := func(params string) *authChallenge {
+		return parseChallenges(http.Header{"Proxy-Authenticate": {"Digest " + params}})[0]
+	}
+	s := &digestSession{
+		state:    &digestState{},
+		username: "user",
+		password: "pass",
+		method:   "CONNECT",
+		uri:      "example.org:443",
+	}
+
+	// No credentials before the challenge
+	if authz, err := s.next(nil); authz != "" || err != nil {
+		t.Fatalf("first request: %q, %v", authz, err)
+	}
+
+	authz, err := s.next(challenge(`realm="proxy", nonce="n1", qop="auth", opaque="o"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parseChallenges(http.Header{"Proxy-Authenticate": {authz}})[0].Params
+	for k, want := range map[string]string{"username": "user", "realm": "proxy", "nonce": "n1", "uri": "example.org:443", "opaque": "o", "qop": "auth", "nc": "00000001"} {
+		if params[k] != want {
+			t.Errorf("%s: got %q, want %q", k, params[k], want)
+		}
+	}
+	if want := s.response("00000001", params["cnonce"]); params["response"] != want {
+		t.Errorf("response: got %s, want %s", params["response"], want)
+	}
+
+	// The same nonce is rejected unless it's stale
+	if _, err := s.next(challenge(`realm="proxy", nonce="n1", qop="auth", stale=true`)); err != nil {
+		t.Errorf("stale nonce: %s", err)
+	}
+	if _, err := s.next(challenge(`realm="proxy", nonce="n1", qop="auth"`)); err != errAuthRejected {
+		t.Errorf("same nonce: got %v, want %v", err, errAuthRejected)
+	}
+
+	unsupported := []string{
+		`realm="proxy", nonce="n2", algorithm=SHA-512-256`,
+		`realm="proxy", nonce="n2", qop="auth-int"`,
+	}
+	for _, params := range unsupported {
+		if _, err := s.next(challenge(params)); err == nil {
+			t.Errorf("%s: accepted", params)
+		}
+	}
+}
+
+func TestBasicSession(t *testing.T) {
+	s := newBasicSession("Aladdin", "open sesame")
+	want := "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ=="
+	if authz, err := s.next(&authChallenge{Scheme: authBasic}); authz != want || err != nil {
+		t.Errorf("got %q, %v, want %q", authz, err, want)
+	}
+	if _, err := s.next(&authChallenge{Scheme: authBasic}); err != errAuthRejected {
+		t.Errorf("got %v, want %v", err, errAuthRejected)
+	}
+}
@@ -0,0 +1,128 @@
+package transproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyTLSConfig is the TLS configuration of connections to https:// upstream proxies.
+type ProxyTLSConfig struct {
+	CAFile     string // PEM bundle of CA certificates, the system roots if it's empty
+	CertFile   string // PEM client certificate for mutual TLS
+	KeyFile    string // PEM private key of CertFile
+	ServerName string // SNI and the name to verify, the host of the URL if it's empty
+
+	// SHA-256 hashes of SubjectPublicKeyInfo in base64, optionally
+	// prefixed with "sha256/". One of the certificates in the verified
+	// chain must match one of them.
+	PinnedPublicKeys []string
+}
+
+// NewProxyTLSConfig loads the files of the configuration.
+func NewProxyTLSConfig(c ProxyTLSConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.PinnedPublicKeys) > 0 {
+		pins := map[string]bool{}
+		for _, p := range c.PinnedPublicKeys {
+			p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+			if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("Invalid pinned public key: %s", p)
+			}
+			pins[p] = true
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("No pinned public keys in the certificate chain of the proxy")
+		}
+	}
+
+	return config, nil
+}
+
+// proxyTLSConfig returns the TLS configuration of the proxy of the address,
+// which verifies the host of the address if ServerName isn't set.
+func proxyTLSConfig(config *tls.Config, addr string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return config
+}
+
+// dialProxyTLS connects to the https:// upstream proxy by TLS.
+func dialProxyTLS(forward proxy.Dialer, network, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	c, err := forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = defaultTunnelHandshakeTimeout
+	}
+	tc := tls.Client(c, proxyTLSConfig(config, addr))
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy %s failed: %s", addr, err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// proxyAddr returns host:port of the upstream proxy URL with the default port of the scheme.
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
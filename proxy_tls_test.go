@@ -0,0 +1,102 @@
+package transproxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempCAFile writes the certificate of the test server as the CA file.
+func tempCAFile(t *testing.T, ts *httptest.Server) (string, string) {
+	dir, err := ioutil.TempDir("", "proxytls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+func TestNewProxyTLSConfigInvalid(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	dir, caFile := tempCAFile(t, ts)
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("no certificates\n"), 0600)
+
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	tests := []struct {
+		name string
+		c    ProxyTLSConfig
+	}{
+		{"pin not base64", ProxyTLSConfig{PinnedPublicKeys: []string{"sha256/not base64!"}}},
+		{"pin of 16 bytes", ProxyTLSConfig{PinnedPublicKeys: []string{short}}},
+		{"pin of hex", ProxyTLSConfig{PinnedPublicKeys: []string{strings.Repeat("ab", sha256.Size)}}},
+		{"no CA file", ProxyTLSConfig{CAFile: filepath.Join(dir, "none.pem")}},
+		{"no certificates in CA file", ProxyTLSConfig{CAFile: empty}},
+		{"certificate without key", ProxyTLSConfig{CertFile: caFile}},
+	}
+	for _, tt := range tests {
+		if _, err := NewProxyTLSConfig(tt.c); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestProxyTLSPinnedPublicKeys(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	dir, caFile := tempCAFile(t, ts)
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("another public key"))
+	wrong := base64.StdEncoding.EncodeToString(other[:])
+
+	tests := []struct {
+		name    string
+		caFile  string
+		pins    []string
+		wantErr string
+	}{
+		{"no pins", caFile, nil, ""},
+		{"pin", caFile, []string{pin}, ""},
+		{"pin with prefix", caFile, []string{"sha256/" + pin}, ""},
+		{"pin with spaces", caFile, []string{" sha256/" + pin + " "}, ""},
+		{"one of pins", caFile, []string{wrong, pin}, ""},
+		{"wrong pin", caFile, []string{"sha256/" + wrong}, "No pinned public keys"},
+		// The pin doesn't skip the verification of the chain
+		{"pin of unknown authority", "", []string{pin}, "certificate"},
+	}
+	for _, tt := range tests {
+		config, err := NewProxyTLSConfig(ProxyTLSConfig{CAFile: tt.caFile, PinnedPublicKeys: tt.pins})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		c, err := dialProxyTLS(&net.Dialer{}, "tcp", ts.Listener.Addr().String(), config, 0)
+		if err == nil {
+			c.Close()
+		}
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: connected", tt.name)
+		case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+			t.Errorf("%s: got %q, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package transproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Close reasons of relays.
+const (
+	CloseClientEOF     = "client EOF"
+	CloseUpstreamEOF   = "upstream EOF"
+	CloseClientReset   = "client reset"
+	CloseUpstreamReset = "upstream reset"
+	CloseIdleTimeout   = "idle timeout"
+	CloseLifetime      = "lifetime exceeded"
+	CloseClosed        = "closed" // closed locally, e.g. force closed on shutdown
+)
+
+const relayBufferSize = 32 * 1024
+
+// relayBufferPool shares buffers of relays, they are used only while
+// transferring, not while idle.
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufferSize)
+		return &b
+	},
+}
+
+// RelayConfig configures timeouts of relays, 0 disables them.
+type RelayConfig struct {
+	// The relay is closed when no bytes are transferred in both directions for the period
+	IdleTimeout time.Duration
+
+	// The relay is closed after the period regardless of activity
+	MaxLifetime time.Duration
+}
+
+// RelayStats is the result of a relay.
+type RelayStats struct {
+	Sent     int64 // bytes from the client to the upstream
+	Received int64 // bytes from the upstream to the client
+	Duration time.Duration
+	Reason   string
+}
+
+// closeWriter is implemented by connections which support half-close,
+// e.g. *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// unwrapper is implemented by connections wrapping another connection, which
+// can be used directly to write, and to read once they have no buffered bytes.
+type unwrapper interface {
+	unwrap(reading bool) (net.Conn, bool)
+}
+
+// tcpConn returns the TCP connection of the reader or the writer, unwrapping
+// the connections which have no buffered bytes for reading. The buffered
+// bytes of the writer aren't looked at, they are read by another goroutine.
+func tcpConn(v interface{}, reading bool) (*net.TCPConn, bool) {
+	for {
+		switch c := v.(type) {
+		case *net.TCPConn:
+			return c, true
+		case unwrapper:
+			inner, ok := c.unwrap(reading)
+			if !ok {
+				return nil, false
+			}
+			v = inner
+		default:
+			return nil, false
+		}
+	}
+}
+
+// relay transfers bytes between the client and the upstream until both
+// directions finish. EOF of one side is propagated to the other side by
+// CloseWrite, so protocols which half-close work. Both connections are
+// closed when it returns.
+type relay struct {
+	RelayConfig
+	client   io.ReadWriteCloser
+	upstream io.ReadWriteCloser
+	start    time.Time
+
+	sent         int64 // atomic
+	received     int64 // atomic
+	lastActivity int64 // atomic, unix nano
+
+	// metrics of relayed bytes, optional
+	sentBytes     *counter
+	receivedBytes *counter
+
+	lock   sync.Mutex
+	reason string
+	closed bool
+}
+
+func newRelay(c RelayConfig, client, upstream io.ReadWriteCloser) *relay {
+	now := time.Now()
+	return &relay{
+		RelayConfig:  c,
+		client:       client,
+		upstream:     upstream,
+		start:        now,
+		lastActivity: now.UnixNano(),
+	}
+}
+
+// Run relays until both directions finish or a timeout.
+func (r *relay) Run() RelayStats {
+	done := make(chan struct{})
+	defer close(done)
+	go r.watch(done)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.copy(r.upstream, r.client, r.counter(&r.sent, r.sentBytes), CloseClientEOF, CloseClientReset, CloseUpstreamReset)
+	}()
+	go func() {
+		defer wg.Done()
+		r.copy(r.client, r.upstream, r.counter(&r.received, r.receivedBytes), CloseUpstreamEOF, CloseUpstreamReset, CloseClientReset)
+	}()
+	wg.Wait()
+
+	r.closeBoth("")
+	return r.Stats()
+}
+
+// Stats returns the current stats of the relay.
+func (r *relay) Stats() RelayStats {
+	r.lock.Lock()
+	reason := r.reason
+	r.lock.Unlock()
+
+	return RelayStats{
+		Sent:     atomic.LoadInt64(&r.sent),
+		Received: atomic.LoadInt64(&r.received),
+		Duration: time.Since(r.start),
+		Reason:   reason,
+	}
+}
+
+// countBytes sets the metrics of relayed bytes.
+func (r *relay) countBytes(sent, received *counter) {
+	r.sentBytes = sent
+	r.receivedBytes = received
+}
+
+// counter returns the function to count transferred bytes by the stats and the metric.
+func (r *relay) counter(stats *int64, metric *counter) func(int64) {
+	return func(n int64) {
+		atomic.AddInt64(stats, n)
+		if metric != nil {
+			metric.Add(n)
+		}
+	}
+}
+
+func (r *relay) copy(dst io.Writer, src io.Reader, count func(int64), eofReason, readErrReason, writeErrReason string) {
+	rerr, werr := r.transfer(dst, src, count)
+	switch {
+	case werr != nil:
+		r.closeBoth(errReason(werr, writeErrReason))
+	case rerr != nil:
+		r.closeBoth(errReason(rerr, readErrReason))
+	default:
+		r.setReason(eofReason)
+		if cw, ok := dst.(closeWriter); ok {
+			if cw.CloseWrite() == nil {
+				return
+			}
+		}
+		// half-close isn't supported
+		r.closeBoth("")
+	}
+}
+
+// transfer copies from src to dst until EOF or an error. The read error
+// is nil on EOF. It splices if it's supported by the platform and the
+// connections, otherwise it copies by a pooled buffer. Connections which
+// replay buffered bytes are spliced after the bytes are copied.
+func (r *relay) transfer(dst io.Writer, src io.Reader, count func(int64)) (rerr, werr error) {
+	var buf *[]byte
+	defer func() {
+		if buf != nil {
+			relayBufferPool.Put(buf)
+		}
+	}()
+
+	for {
+		if ok, rerr, werr := spliceTransfer(dst, src, r.touch, count); ok {
+			return rerr, werr
+		}
+		if buf == nil {
+			buf = relayBufferPool.Get().(*[]byte)
+		}
+
+		n, err := src.Read(*buf)
+		if n > 0 {
+			r.touch()
+			w, err := dst.Write((*buf)[:n])
+			count(int64(w))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+// touch records activity for the idle timeout.
+func (r *relay) touch() {
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+}
+
+// watch closes the relay by the timeouts.
+func (r *relay) watch(done chan struct{}) {
+	if r.IdleTimeout <= 0 && r.MaxLifetime <= 0 {
+		return
+	}
+
+	var lifetime <-chan time.Time
+	if r.MaxLifetime > 0 {
+		timer := time.NewTimer(r.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if r.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(r.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetime:
+			r.closeBoth(CloseLifetime)
+			return
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(&r.lastActivity))
+			if remaining := r.IdleTimeout - time.Since(last); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			r.closeBoth(CloseIdleTimeout)
+			return
+		}
+	}
+}
+
+// setReason sets the close reason. An abort reason overrides EOF because
+// the abort is the cause of the close then, and reasons after the close
+// are ignored because they are the consequences.
+func (r *relay) setReason(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.setReasonLocked(reason)
+}
+
+func (r *relay) setReasonLocked(reason string) {
+	if r.closed || reason == "" {
+		return
+	}
+	if r.reason == "" || (isEOFReason(r.reason) && !isEOFReason(reason)) {
+		r.reason = reason
+	}
+}
+
+func (r *relay) closeBoth(reason string) {
+	r.lock.Lock()
+	r.setReasonLocked(reason)
+	closed := r.closed
+	r.closed = true
+	r.lock.Unlock()
+
+	if !closed {
+		r.client.Close()
+		r.upstream.Close()
+	}
+}
+
+func isEOFReason(reason string) bool {
+	return reason == CloseClientEOF || reason == CloseUpstreamEOF
+}
+
+// errReason returns CloseClosed for errors of the connection closed locally.
+func errReason(err error, reason string) string {
+	if errors.Is(err, net.ErrClosed) {
+		return CloseClosed
+	}
+	return reason
+}
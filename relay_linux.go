@@ -0,0 +1,84 @@
+package transproxy
+
+import (
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// max bytes moved by a splice call, the pipe buffer limits it actually
+const maxSpliceSize = 1 << 20
+
+// spliceTransfer moves bytes from src to dst by splice(2) through a pipe
+// without copying them to userspace. It's used only when both are TCP
+// connections without buffered bytes, it returns false otherwise.
+func spliceTransfer(dst io.Writer, src io.Reader, touch func(), count func(int64)) (ok bool, rerr, werr error) {
+	srcTCP, ok1 := tcpConn(src, true)
+	dstTCP, ok2 := tcpConn(dst, false)
+	if !ok1 || !ok2 {
+		return false, nil, nil
+	}
+	srcRaw, err := srcTCP.SyscallConn()
+	if err != nil {
+		return false, nil, nil
+	}
+	dstRaw, err := dstTCP.SyscallConn()
+	if err != nil {
+		return false, nil, nil
+	}
+
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return false, nil, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	for {
+		// socket to pipe
+		var n int64
+		var serr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			for {
+				n, serr = unix.Splice(int(fd), nil, p[1], nil, maxSpliceSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				if serr != syscall.EINTR {
+					// wait for readable on EAGAIN
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return true, err, nil
+		}
+		if n == 0 {
+			return true, nil, nil
+		}
+		touch()
+
+		// pipe to socket
+		for n > 0 {
+			var m int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				for {
+					m, serr = unix.Splice(p[0], nil, int(fd), nil, int(n), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+					if serr != syscall.EINTR {
+						// wait for writable on EAGAIN
+						return serr != syscall.EAGAIN
+					}
+				}
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return true, nil, err
+			}
+			n -= m
+			count(m)
+		}
+	}
+}
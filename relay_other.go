@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package transproxy
+
+import "io"
+
+// spliceTransfer isn't supported, bytes are copied by buffers.
+func spliceTransfer(dst io.Writer, src io.Reader, touch func(), count func(int64)) (ok bool, rerr, werr error) {
+	return false, nil, nil
+}
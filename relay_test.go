@@ -0,0 +1,311 @@
+package transproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const benchmarkChunkSize = 1 << 20
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		tb.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// relayThrough writes the data into the client side, transfers it to the
+// upstream side by the function, and copies the bytes read from the upstream
+// side into w. It returns the number of the bytes.
+func relayThrough(tb testing.TB, wrap func(*net.TCPConn) io.Reader, transfer func(dst io.Writer, src io.Reader), write func(w *net.TCPConn), w io.Writer) int64 {
+	in, src := tcpPair(tb)
+	dst, out := tcpPair(tb)
+	defer in.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer out.Close()
+
+	go func() {
+		write(in)
+		in.CloseWrite()
+	}()
+	go func() {
+		transfer(dst, wrap(src))
+		dst.CloseWrite()
+	}()
+
+	n, err := io.Copy(w, out)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+func TestRelayTransferReplayConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		peeked string
+	}{
+		{"no peeked bytes", ""},
+		{"peeked bytes", "GET / HTTP/1.1\r\n"},
+	}
+	for _, tt := range tests {
+		var rc *replayConn
+		var got bytes.Buffer
+		relayThrough(t,
+			func(c *net.TCPConn) io.Reader {
+				rc = &replayConn{Conn: c, peeked: bytes.NewReader([]byte(tt.peeked))}
+				return rc
+			},
+			func(dst io.Writer, src io.Reader) {
+				newRelay(RelayConfig{}, nil, nil).transfer(dst, src, func(int64) {})
+			},
+			func(w *net.TCPConn) {
+				w.Write([]byte("Host: example.org\r\n\r\n"))
+			},
+			&got,
+		)
+		if want := tt.peeked + "Host: example.org\r\n\r\n"; got.String() != want {
+			t.Errorf("%s: got %q, want %q", tt.name, got.String(), want)
+		}
+		if _, ok := tcpConn(rc, true); !ok {
+			t.Errorf("%s: not unwrapped after the peeked bytes are replayed", tt.name)
+		}
+	}
+
+	rc := &replayConn{peeked: bytes.NewReader([]byte("x"))}
+	if _, ok := tcpConn(rc, true); ok {
+		t.Error("unwrapped with the peeked bytes")
+	}
+	if _, ok := tcpConn(&replayConn{Conn: &net.TCPConn{}, peeked: bytes.NewReader([]byte("x"))}, false); !ok {
+		t.Error("not unwrapped for writing with the peeked bytes")
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	tests := []struct {
+		name      string
+		pipe      bool // the upstream is net.Pipe without half-close
+		peeked    string
+		halfClose bool
+	}{
+		{"tcp", false, "", true},
+		{"replayConn", false, "early ", true},
+		{"no half-close", true, "", false},
+	}
+	for _, tt := range tests {
+		clientApp, clientSide := tcpPair(t)
+		var upstreamSide, upstreamApp net.Conn
+		if tt.pipe {
+			upstreamSide, upstreamApp = net.Pipe()
+		} else {
+			upstreamSide, upstreamApp = tcpPair(t)
+		}
+		var client io.ReadWriteCloser = clientSide
+		if tt.peeked != "" {
+			client = &replayConn{Conn: clientSide, peeked: bytes.NewReader([]byte(tt.peeked))}
+		}
+
+		stats := make(chan RelayStats, 1)
+		go func() {
+			stats <- newRelay(RelayConfig{}, client, upstreamSide).Run()
+		}()
+
+		// The client shuts down sending, the upstream still responds
+		clientApp.Write([]byte("request"))
+		clientApp.CloseWrite()
+		got, _ := ioutil.ReadAll(upstreamApp)
+		if want := tt.peeked + "request"; string(got) != want {
+			t.Errorf("%s: upstream got %q, want %q", tt.name, got, want)
+		}
+		_, err := upstreamApp.Write([]byte("response"))
+		upstreamApp.Close()
+		if tt.halfClose && err != nil {
+			t.Errorf("%s: the upstream can't respond after the client EOF: %s", tt.name, err)
+		}
+		got, _ = ioutil.ReadAll(clientApp)
+		want := "response"
+		if !tt.halfClose {
+			want = ""
+		}
+		if string(got) != want {
+			t.Errorf("%s: client got %q, want %q", tt.name, got, want)
+		}
+
+		st := <-stats
+		if st.Reason != CloseClientEOF {
+			t.Errorf("%s: reason %q, want %q", tt.name, st.Reason, CloseClientEOF)
+		}
+		if st.Sent != int64(len(tt.peeked+"request")) || st.Received != int64(len(want)) {
+			t.Errorf("%s: sent %d, received %d", tt.name, st.Sent, st.Received)
+		}
+		clientApp.Close()
+	}
+}
+
+func TestRelayCloseReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       RelayConfig
+		traffic      bool // the client keeps sending
+		closeLocally bool // the client connection is closed by another goroutine
+		want         string
+		minDuration  time.Duration
+	}{
+		{"idle timeout", RelayConfig{IdleTimeout: 50 * time.Millisecond}, false, false, CloseIdleTimeout, 50 * time.Millisecond},
+		{"not idle", RelayConfig{IdleTimeout: 100 * time.Millisecond, MaxLifetime: 300 * time.Millisecond}, true, false, CloseLifetime, 300 * time.Millisecond},
+		{"lifetime", RelayConfig{MaxLifetime: 50 * time.Millisecond}, false, false, CloseLifetime, 50 * time.Millisecond},
+		{"closed", RelayConfig{}, false, true, CloseClosed, 0},
+	}
+	for _, tt := range tests {
+		clientApp, clientSide := tcpPair(t)
+		upstreamSide, upstreamApp := tcpPair(t)
+
+		stats := make(chan RelayStats, 1)
+		go func() {
+			stats <- newRelay(tt.config, clientSide, upstreamSide).Run()
+		}()
+		go io.Copy(ioutil.Discard, upstreamApp)
+
+		done := make(chan struct{})
+		if tt.traffic {
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(20 * time.Millisecond):
+						clientApp.Write([]byte("x"))
+					}
+				}
+			}()
+		}
+		if tt.closeLocally {
+			time.Sleep(20 * time.Millisecond)
+			clientSide.Close()
+		}
+
+		var st RelayStats
+		select {
+		case st = <-stats:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: not closed", tt.name)
+		}
+		close(done)
+
+		if st.Reason != tt.want {
+			t.Errorf("%s: reason %q, want %q", tt.name, st.Reason, tt.want)
+		}
+		if st.Duration < tt.minDuration {
+			t.Errorf("%s: closed after %s, want %s or later", tt.name, st.Duration, tt.minDuration)
+		}
+		// Both connections are closed. The client connection is reset if
+		// the client sent data which the relay didn't read.
+		clientApp.SetReadDeadline(time.Now().Add(time.Second))
+		upstreamApp.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ioutil.ReadAll(clientApp); err != nil && !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("%s: client not closed: %s", tt.name, err)
+		}
+		if _, err := upstreamApp.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: upstream not closed: %v", tt.name, err)
+		}
+		clientApp.Close()
+		upstreamApp.Close()
+	}
+}
+
+// readerOnly and writerOnly hide the connections, so they are neither
+// spliced nor copied by ReadFrom and WriteTo.
+type readerOnly struct {
+	io.Reader
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+func benchmarkRelay(b *testing.B, wrap func(*net.TCPConn) io.Reader, transfer func(dst io.Writer, src io.Reader)) {
+	chunk := make([]byte, benchmarkChunkSize)
+	b.SetBytes(benchmarkChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	n := relayThrough(b, wrap, transfer, func(w *net.TCPConn) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}, ioutil.Discard)
+	if n != int64(b.N)*benchmarkChunkSize {
+		b.Fatalf("relayed %d bytes, want %d", n, int64(b.N)*benchmarkChunkSize)
+	}
+}
+
+func relayTransfer(dst io.Writer, src io.Reader) {
+	newRelay(RelayConfig{}, nil, nil).transfer(dst, src, func(int64) {})
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("splice is supported on Linux only")
+	}
+	benchmarkRelay(b,
+		func(c *net.TCPConn) io.Reader { return c },
+		relayTransfer,
+	)
+}
+
+func BenchmarkRelaySpliceReplayConn(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("splice is supported on Linux only")
+	}
+	benchmarkRelay(b,
+		func(c *net.TCPConn) io.Reader { return &replayConn{Conn: c, peeked: bytes.NewReader(nil)} },
+		relayTransfer,
+	)
+}
+
+func BenchmarkRelayPooledBuffer(b *testing.B) {
+	benchmarkRelay(b,
+		func(c *net.TCPConn) io.Reader { return readerOnly{c} },
+		relayTransfer,
+	)
+}
+
+func BenchmarkRelayIOCopy(b *testing.B) {
+	benchmarkRelay(b,
+		func(c *net.TCPConn) io.Reader { return readerOnly{c} },
+		func(dst io.Writer, src io.Reader) {
+			io.Copy(writerOnly{dst}, src)
+		},
+	)
+}
@@ -0,0 +1,246 @@
+package transproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Actions of routing rules.
+const (
+	// ActionProxy resolves the name to a synthetic IP and connects through the upstream proxy.
+	ActionProxy = "proxy"
+
+	// ActionDirect resolves the name to a synthetic IP and connects directly
+	// to the address resolved by the private DNS servers.
+	ActionDirect = "direct"
+
+	// ActionPrivate forwards DNS queries to the private DNS servers,
+	// so clients connect to the target without transproxy.
+	ActionPrivate = "private"
+
+	// ActionBlock replies NXDOMAIN to DNS queries and rejects connections.
+	ActionBlock = "block"
+)
+
+// RuleConfig is a routing rule.
+//
+// Match is one of:
+//
+//	example.org         exact domain
+//	.example.org        the domain and its subdomains
+//	*.example.org       wildcard, * matches any characters including dots
+//	regexp:^foo\d+\.    regular expression
+//	10.0.0.0/8          CIDR, matches IP address targets
+//
+// Port limits the rule to connections to the ports. Rules with ports are skipped
+// when DNS queries are routed because the port is unknown then.
+type RuleConfig struct {
+	Match    string
+	Port     []int
+	Action   string
+	Upstream string // Upstream proxy for ActionProxy, the default one if it's empty
+}
+
+// Decision is the result of routing.
+type Decision struct {
+	Action   string
+	Upstream string
+	Rule     string // the matched rule, "default" if none matched
+}
+
+// Rules is an ordered list of routing rules, the first matched rule wins.
+type Rules struct {
+	lock  sync.RWMutex
+	rules []*rule
+}
+
+type rule struct {
+	RuleConfig
+	match func(host string) bool
+}
+
+// NewRules compiles the rules. Entries of no_proxy are appended as rules
+// which route the domains and their subdomains to the private DNS servers.
+func NewRules(configs []RuleConfig, noProxy []string) (*Rules, error) {
+	rules := &Rules{}
+	for i, c := range configs {
+		r, err := compileRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule #%d '%s': %s", i+1, c.Match, err)
+		}
+		rules.rules = append(rules.rules, r)
+	}
+
+	for _, s := range noProxy {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		c := RuleConfig{Match: s, Action: ActionPrivate}
+		if s != "*" && net.ParseIP(s) == nil && !strings.Contains(s, "/") && !strings.HasPrefix(s, ".") {
+			// no_proxy matches subdomains too
+			c.Match = "." + s
+		}
+		r, err := compileRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid no_proxy '%s': %s", s, err)
+		}
+		rules.rules = append(rules.rules, r)
+	}
+
+	return rules, nil
+}
+
+func compileRule(c RuleConfig) (*rule, error) {
+	switch c.Action {
+	case "":
+		c.Action = ActionProxy
+	case ActionProxy, ActionDirect, ActionPrivate, ActionBlock:
+	default:
+		return nil, fmt.Errorf("Unknown action: %s", c.Action)
+	}
+	if c.Upstream != "" && c.Action != ActionProxy {
+		return nil, fmt.Errorf("Upstream is only for %s action", ActionProxy)
+	}
+	for _, p := range c.Port {
+		if p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("Invalid port: %d", p)
+		}
+	}
+
+	m := strings.TrimSpace(c.Match)
+	r := &rule{RuleConfig: c}
+
+	switch {
+	case m == "":
+		return nil, fmt.Errorf("Empty match")
+
+	case strings.HasPrefix(m, "regexp:"):
+		re, err := regexp.Compile(strings.TrimPrefix(m, "regexp:"))
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(host string) bool {
+			return re.MatchString(host)
+		}
+
+	case strings.Contains(m, "/"):
+		_, ipnet, err := net.ParseCIDR(m)
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(host string) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && ipnet.Contains(ip)
+		}
+
+	case strings.Contains(m, "*"):
+		pattern := "^" + strings.Replace(regexp.QuoteMeta(normalizeHost(m)), `\*`, ".*", -1) + "$"
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(host string) bool {
+			return re.MatchString(host)
+		}
+
+	case strings.HasPrefix(m, "."):
+		domain := normalizeHost(m[1:])
+		r.match = func(host string) bool {
+			return host == domain || strings.HasSuffix(host, "."+domain)
+		}
+
+	default:
+		exact := normalizeHost(m)
+		if ip := net.ParseIP(exact); ip != nil {
+			r.match = func(host string) bool {
+				hostIP := net.ParseIP(host)
+				return hostIP != nil && hostIP.Equal(ip)
+			}
+		} else {
+			r.match = func(host string) bool {
+				return host == exact
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// Match routes the host and the port. Port 0 means a DNS query.
+func (r *Rules) Match(host string, port int) Decision {
+	h := normalizeHost(host)
+
+	if r != nil {
+		r.lock.RLock()
+		rules := r.rules
+		r.lock.RUnlock()
+
+		for _, rule := range rules {
+			if !rule.matchPort(port) || !rule.match(h) {
+				continue
+			}
+			d := Decision{
+				Action:   rule.Action,
+				Upstream: rule.Upstream,
+				Rule:     rule.String(),
+			}
+			log.Printf("debug: category='Rule' Matched! host: %s, port: %d, rule: %s, action: %s", host, port, d.Rule, d.Action)
+			return d
+		}
+	}
+
+	log.Printf("debug: category='Rule' No rules matched, host: %s, port: %d, action: %s", host, port, ActionProxy)
+	return Decision{
+		Action: ActionProxy,
+		Rule:   "default",
+	}
+}
+
+// Update replaces the rules by the other ones, which are used by the
+// following matches.
+func (r *Rules) Update(other *Rules) {
+	other.lock.RLock()
+	rules := other.rules
+	other.lock.RUnlock()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = rules
+}
+
+func (r *rule) matchPort(port int) bool {
+	if len(r.Port) == 0 {
+		return true
+	}
+	if port == 0 {
+		return false
+	}
+	for _, p := range r.Port {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) String() string {
+	s := r.Match
+	if len(r.Port) > 0 {
+		s += fmt.Sprintf(" port %v", r.Port)
+	}
+	s += " => " + r.Action
+	if r.Upstream != "" {
+		s += " " + r.Upstream
+	}
+	return s
+}
+
+// normalizeHost lowers the host name and removes the trailing dot of FQDN.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,109 @@
+package transproxy
+
+import "testing"
+
+func TestNewRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []RuleConfig
+		noProxy []string
+	}{
+		{"empty match", []RuleConfig{{Match: " "}}, nil},
+		{"unknown action", []RuleConfig{{Match: "example.org", Action: "reject"}}, nil},
+		{"upstream of direct", []RuleConfig{{Match: "example.org", Action: ActionDirect, Upstream: "corp"}}, nil},
+		{"port 0", []RuleConfig{{Match: "example.org", Port: []int{0}}}, nil},
+		{"port over 65535", []RuleConfig{{Match: "example.org", Port: []int{65536}}}, nil},
+		{"invalid regexp", []RuleConfig{{Match: "regexp:("}}, nil},
+		{"invalid CIDR", []RuleConfig{{Match: "10.0.0.0/33"}}, nil},
+		{"invalid no_proxy", nil, []string{"10.0.0.0/33"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewRules(tt.configs, tt.noProxy); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := NewRules([]RuleConfig{
+		{Match: "*.ads.example.com", Action: ActionBlock},
+		{Match: `regexp:^git[0-9]+\.example\.com$`, Port: []int{22}, Upstream: "ssh"},
+		{Match: "10.0.0.0/8", Action: ActionDirect},
+		{Match: "192.168.1.1", Action: ActionDirect},
+		{Match: "Intranet.Example.com", Action: ActionPrivate},
+	}, []string{".example.org", "corp.local", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		port     int
+		action   string
+		upstream string
+	}{
+		// wildcard
+		{"a.ads.example.com", 443, ActionBlock, ""},
+		{"a.b.ads.example.com.", 0, ActionBlock, ""},
+		{"ads.example.com", 443, ActionProxy, ""},
+
+		// regexp with the port
+		{"git1.example.com", 22, ActionProxy, "ssh"},
+		{"git1.example.com", 443, ActionProxy, ""},
+		{"git1.example.com", 0, ActionProxy, ""},
+		{"gitx.example.com", 22, ActionProxy, ""},
+
+		// CIDR and IP address
+		{"10.1.2.3", 443, ActionDirect, ""},
+		{"11.1.2.3", 443, ActionProxy, ""},
+		{"192.168.1.1", 80, ActionDirect, ""},
+		{"192.168.1.2", 80, ActionProxy, ""},
+
+		// exact domain is case insensitive
+		{"intranet.example.com.", 0, ActionPrivate, ""},
+		{"www.intranet.example.com", 0, ActionProxy, ""},
+
+		// no_proxy matches the domain and its subdomains
+		{"example.org", 0, ActionPrivate, ""},
+		{"a.example.org.", 443, ActionPrivate, ""},
+		{"badexample.org", 0, ActionProxy, ""},
+		{"x.CORP.local", 0, ActionPrivate, ""},
+		{"corp.local", 0, ActionPrivate, ""},
+	}
+	for _, tt := range tests {
+		d := rules.Match(tt.host, tt.port)
+		if d.Action != tt.action || d.Upstream != tt.upstream {
+			t.Errorf("%s:%d: got %s %q by %s, want %s %q", tt.host, tt.port, d.Action, d.Upstream, d.Rule, tt.action, tt.upstream)
+		}
+	}
+
+	if d := rules.Match("www.example.com", 443); d.Rule != "default" {
+		t.Errorf("matched by %s, want default", d.Rule)
+	}
+}
+
+func TestRulesNoProxyAll(t *testing.T) {
+	rules, err := NewRules([]RuleConfig{{Match: "proxied.example.org"}}, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := rules.Match("proxied.example.org", 443); d.Action != ActionProxy {
+		t.Errorf("got %s, want %s", d.Action, ActionProxy)
+	}
+	if d := rules.Match("www.example.com", 443); d.Action != ActionPrivate {
+		t.Errorf("got %s, want %s", d.Action, ActionPrivate)
+	}
+}
+
+func TestRulesUpdate(t *testing.T) {
+	rules, _ := NewRules(nil, []string{"example.org"})
+	other, _ := NewRules([]RuleConfig{{Match: "example.org", Action: ActionBlock}}, nil)
+	rules.Update(other)
+	if d := rules.Match("example.org", 0); d.Action != ActionBlock {
+		t.Errorf("got %s, want %s", d.Action, ActionBlock)
+	}
+	var none *Rules
+	if d := none.Match("example.org", 0); d.Action != ActionProxy || d.Rule != "default" {
+		t.Errorf("nil rules: %+v", d)
+	}
+}
@@ -0,0 +1,160 @@
+package transproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Protocols sniffed for recovering the target host name.
+const (
+	SniffNone = ""
+	SniffTLS  = "tls"  // TLS ClientHello SNI
+	SniffHTTP = "http" // HTTP Host header
+)
+
+// Policies when the sniffed host name and the mapped host name disagree.
+const (
+	HostPolicyPreferMapping = "prefer-mapping"
+	HostPolicyPreferSNI     = "prefer-sni"
+	HostPolicyReject        = "reject"
+)
+
+const sniffTimeout = 5 * time.Second
+
+var errSniffed = errors.New("sniffed")
+
+// replayConn replays the peeked bytes before reading from the connection.
+type replayConn struct {
+	net.Conn
+	peeked *bytes.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if c.peeked.Len() > 0 {
+		return c.peeked.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// unwrap returns the connection to write, or to read after the peeked bytes
+// are replayed, so it can be spliced.
+func (c *replayConn) unwrap(reading bool) (net.Conn, bool) {
+	if reading && c.peeked.Len() > 0 {
+		return nil, false
+	}
+	return c.Conn, true
+}
+
+// CloseWrite half-closes the connection if it's supported.
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite isn't supported")
+}
+
+// readOnlyConn discards writes while sniffing, so the client never sees them.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// sniffHost peeks the head of the client stream by the protocol and returns
+// the host name sent by the client. The returned connection replays the
+// peeked bytes, so it must be used instead of the given one.
+func sniffHost(conn net.Conn, protocol string) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	tee := io.TeeReader(conn, &peeked)
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+
+	var host string
+	var err error
+	switch protocol {
+	case SniffTLS:
+		host, err = sniffSNI(&readOnlyConn{Conn: conn, r: tee})
+	case SniffHTTP:
+		host, err = sniffHTTPHost(tee)
+	default:
+		err = errors.New("Unknown sniff protocol: " + protocol)
+	}
+
+	var zero time.Time
+	conn.SetReadDeadline(zero)
+
+	return host, &replayConn{
+		Conn:   conn,
+		peeked: bytes.NewReader(peeked.Bytes()),
+	}, err
+}
+
+func sniffSNI(conn net.Conn) (string, error) {
+	var host string
+	tls.Server(conn, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+
+	if host == "" {
+		return "", errors.New("No SNI in TLS ClientHello")
+	}
+	return host, nil
+}
+
+func sniffHTTPHost(r io.Reader) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return "", err
+	}
+	if req.Host == "" {
+		return "", errors.New("No Host header in HTTP request")
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		// No port
+		return req.Host, nil
+	}
+	return host, nil
+}
+
+// chooseHost decides the target host name from the mapped and the sniffed ones by the policy.
+func chooseHost(mapped, sniffed, policy string) (string, error) {
+	if sniffed == "" {
+		if mapped == "" {
+			return "", errors.New("No host name by mapping nor sniffing")
+		}
+		return mapped, nil
+	}
+	if mapped == "" {
+		return sniffed, nil
+	}
+	if strings.EqualFold(strings.TrimSuffix(mapped, "."), strings.TrimSuffix(sniffed, ".")) {
+		return mapped, nil
+	}
+
+	switch policy {
+	case HostPolicyPreferSNI:
+		return sniffed, nil
+	case HostPolicyReject:
+		return "", errors.New("Sniffed host name '" + sniffed + "' disagrees with mapped host name '" + mapped + "'")
+	default:
+		return mapped, nil
+	}
+}
@@ -1,10 +1,17 @@
 package transproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Proxy interface {
@@ -12,72 +19,346 @@ type Proxy interface {
 	Stop()
 	GetListenPort() int
 	GetType() string
+
+	// StartContext starts the proxy, which is stopped gracefully when the context is done.
+	StartContext(ctx context.Context) error
+
+	// StopContext stops accepting new connections and waits for the active ones
+	// until the context is done, then force closes them. It returns after all
+	// connections are closed.
+	StopContext(ctx context.Context) error
 }
 
 type Transproxy struct {
 	TransproxyConfig
-	dnsProxy *DNSProxy
-	proxies  []Proxy
+	dnsProxy  *DNSProxy
+	upstreams *UpstreamPool
+	rules     *Rules
+	acl       *ClientACL
+	gateway   *Gateway
+	admin     *AdminServer
+	metrics   *http.Server
+
+	lock    sync.Mutex // guards proxies and TransproxyConfig on reload
+	proxies []Proxy
+}
+
+// connectionProxy is a Proxy which can list and close its active connections.
+type connectionProxy interface {
+	Connections() []ConnInfo
+	CloseConnection(id uint64) bool
 }
 
 type TransproxyConfig struct {
-	DNSListenAddress string
-	DNSEnableUDP     bool
-	DNSEnableTCP     bool
-	PrivateDNS       []string
-	NoProxy          []string
-	StartLocalIP     string
-	EndLocalIP       string
+	DNSListenAddresses  []string
+	DNSEnableUDP        bool
+	DNSEnableTCP        bool
+	PrivateDNS          []string
+	PublicDNS           []string
+	TunnelDNS           []string
+	NoProxy             []string
+	Rules               []RuleConfig
+	StartLocalIP        string
+	EndLocalIP          string
+	SyntheticIPv6Prefix string
+	MappingFile         string
+	MappingRetention    time.Duration
+
+	// Clients allowed or denied by CIDRs or IP addresses, all clients are
+	// allowed if both are empty
+	AllowClients []string
+	DenyClients  []string
+
+	// Gateway mode routes the synthetic IP addresses of GatewayPool to
+	// GatewayInterface and listens DNS on its address, so other hosts can use
+	// the proxies. StartLocalIP and EndLocalIP are replaced by the pool.
+	// Disabled if GatewayInterface is empty.
+	GatewayInterface string
+	GatewayPool      string
+
+	// Path of resolv.conf managed on Linux, /etc/resolv.conf if it's empty
+	ResolvConf string
+
+	// Path of the journal of the original DNS settings, the default is by the OS
+	DNSJournal string
 
 	ProxyListenPorts []int
+
+	// Bind address of the proxy listeners, all interfaces if it's empty
+	ProxyBindAddress string
 	ProxyURL         *url.URL
+
+	// TLS configuration of https:// upstream proxies, overridden by UpstreamConfig.TLS
+	ProxyTLS *tls.Config
+
+	// Upstream proxies, ProxyURL is used if it's empty
+	Upstreams           []UpstreamConfig
+	UpstreamPolicy      string
+	HealthCheckInterval time.Duration
+	HealthCheckTarget   string
+
+	// Timeouts of connecting to upstream proxies and CONNECT handshakes
+	ProxyDialTimeout      time.Duration
+	ProxyHandshakeTimeout time.Duration
+
+	// Ports whose target host name is sniffed from TLS SNI or HTTP Host header.
+	// Every connection to the ports is held until the client sends them or
+	// the sniff times out in 5s, so the host name is recovered when the reverse
+	// lookup misses, and compared with the mapped one by HostPolicy. Don't set
+	// ports where the server speaks first, e.g. SSH and SMTP.
+	SniffTLSPorts  []int
+	SniffHTTPPorts []int
+	HostPolicy     string
+
+	// Ports proxied by sending absolute-URI HTTP requests instead of CONNECT
+	HTTPForwardListenPorts []int
+
+	// Connections are closed when they are idle for IdleTimeout or alive for MaxConnectionLifetime, 0 disables them
+	IdleTimeout           time.Duration
+	MaxConnectionLifetime time.Duration
+
+	// Active connections are waited for the period on Stop, then force closed
+	ShutdownGracePeriod time.Duration
+
+	// Listen address of the admin API, disabled if it's empty
+	AdminListenAddress string
+	AdminToken         string
+
+	// Listen address of /metrics without authentication, disabled if it's empty.
+	// The host is 127.0.0.1 if it's empty.
+	MetricsListenAddress string
 }
 
-func NewTransproxy(c TransproxyConfig) *Transproxy {
-	// Add proxy host to no_proxy list
-	proxyHost := strings.Split(c.ProxyURL.Host, ":")
-	c.NoProxy = append(c.NoProxy, proxyHost[0])
+func NewTransproxy(c TransproxyConfig) (*Transproxy, error) {
+	c, gateway, err := applyGateway(c)
+	if err != nil {
+		return nil, err
+	}
 
-	dnsProxy := NewDNSProxy(
+	upstreams, err := NewUpstreamPool(upstreamPoolConfig(c))
+	if err != nil {
+		return nil, err
+	}
+
+	// Add proxy hosts to no_proxy list
+	c.NoProxy = withUpstreamHosts(c.NoProxy, upstreams)
+
+	rules, err := NewRules(c.Rules, c.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := NewClientACL(c.AllowClients, c.DenyClients)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappingStore MappingStore
+	if c.MappingFile != "" {
+		store, err := NewFileMappingStore(c.MappingFile, c.MappingRetention)
+		if err != nil {
+			log.Printf("warn: category='DNS-Proxy' Can't open the mapping file, mappings won't be persisted: %s", err)
+		} else {
+			mappingStore = store
+		}
+	}
+
+	var publicResolver Resolver
+	if len(c.TunnelDNS) > 0 {
+		publicResolver = NewTunnelResolver(c.TunnelDNS, upstreams)
+	}
+
+	dnsProxy, err := NewDNSProxy(
 		DNSProxyConfig{
-			DNSListenAddress: c.DNSListenAddress,
-			DNSEnableUDP:     c.DNSEnableUDP,
-			DNSEnableTCP:     c.DNSEnableTCP,
-			PrivateDNS:       c.PrivateDNS,
-			NoProxy:          c.NoProxy,
-			StartLocalIP:     c.StartLocalIP,
-			EndLocalIP:       c.EndLocalIP,
+			DNSListenAddresses:  c.DNSListenAddresses,
+			DNSEnableUDP:        c.DNSEnableUDP,
+			DNSEnableTCP:        c.DNSEnableTCP,
+			PrivateDNS:          c.PrivateDNS,
+			PublicDNS:           c.PublicDNS,
+			PublicResolver:      publicResolver,
+			NoProxy:             c.NoProxy,
+			Rules:               rules,
+			ACL:                 acl,
+			StartLocalIP:        c.StartLocalIP,
+			EndLocalIP:          c.EndLocalIP,
+			MappingStore:        mappingStore,
+			SyntheticIPv6Prefix: c.SyntheticIPv6Prefix,
+			ResolvConf:          c.ResolvConf,
+			DNSJournal:          c.DNSJournal,
 		},
 	)
+	if err != nil {
+		if mappingStore != nil {
+			mappingStore.Close()
+		}
+		return nil, err
+	}
 
-	proxies := []Proxy{}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+
+	t := &Transproxy{
+		TransproxyConfig: c,
+		dnsProxy:         dnsProxy,
+		upstreams:        upstreams,
+		rules:            rules,
+		acl:              acl,
+		gateway:          gateway,
+	}
 	for _, p := range c.ProxyListenPorts {
-		proxy := NewPassThroughProxy(
-			PassThroughProxyConfig{
-				ListenAddress: fmt.Sprintf(":%d", p),
-				ProxyURL:      c.ProxyURL,
-				DNSProxy:      dnsProxy,
+		t.proxies = append(t.proxies, t.newPassThroughProxy(c, p))
+	}
+	for _, p := range c.HTTPForwardListenPorts {
+		t.proxies = append(t.proxies, t.newHTTPForwardProxy(c, p))
+	}
+
+	if c.AdminListenAddress != "" {
+		admin, err := NewAdminServer(
+			AdminServerConfig{
+				ListenAddress: c.AdminListenAddress,
+				Token:         c.AdminToken,
+				Transproxy:    t,
 			},
 		)
-		proxies = append(proxies, proxy)
+		if err != nil {
+			if mappingStore != nil {
+				mappingStore.Close()
+			}
+			return nil, err
+		}
+		t.admin = admin
 	}
 
-	return &Transproxy{
-		TransproxyConfig: c,
-		dnsProxy:         dnsProxy,
-		proxies:          proxies,
+	return t, nil
+}
+
+func (s *Transproxy) newPassThroughProxy(c TransproxyConfig, port int) Proxy {
+	return NewPassThroughProxy(
+		PassThroughProxyConfig{
+			ListenAddress: net.JoinHostPort(c.ProxyBindAddress, strconv.Itoa(port)),
+			Upstreams:     s.upstreams,
+			DNSProxy:      s.dnsProxy,
+			Sniff:         sniffProtocol(c, port),
+			HostPolicy:    c.HostPolicy,
+			Rules:         s.rules,
+			ACL:           s.acl,
+
+			Relay:               relayConfig(c),
+			ShutdownGracePeriod: c.ShutdownGracePeriod,
+		},
+	)
+}
+
+func (s *Transproxy) newHTTPForwardProxy(c TransproxyConfig, port int) Proxy {
+	return NewHTTPForwardProxy(
+		HTTPForwardProxyConfig{
+			ListenAddress: net.JoinHostPort(c.ProxyBindAddress, strconv.Itoa(port)),
+			Upstreams:     s.upstreams,
+			DNSProxy:      s.dnsProxy,
+			HostPolicy:    c.HostPolicy,
+			Rules:         s.rules,
+			ACL:           s.acl,
+
+			Relay:               relayConfig(c),
+			ShutdownGracePeriod: c.ShutdownGracePeriod,
+		},
+	)
+}
+
+func relayConfig(c TransproxyConfig) RelayConfig {
+	return RelayConfig{
+		IdleTimeout: c.IdleTimeout,
+		MaxLifetime: c.MaxConnectionLifetime,
 	}
 }
 
+func upstreamPoolConfig(c TransproxyConfig) UpstreamPoolConfig {
+	upstreams := c.Upstreams
+	if len(upstreams) == 0 && c.ProxyURL != nil {
+		upstreams = []UpstreamConfig{
+			{URL: c.ProxyURL},
+		}
+	}
+	return UpstreamPoolConfig{
+		Upstreams:           upstreams,
+		Policy:              c.UpstreamPolicy,
+		HealthCheckInterval: c.HealthCheckInterval,
+		HealthCheckTarget:   c.HealthCheckTarget,
+		Tunnel: TunnelConfig{
+			DialTimeout:      c.ProxyDialTimeout,
+			HandshakeTimeout: c.ProxyHandshakeTimeout,
+			TLS:              c.ProxyTLS,
+		},
+	}
+}
+
+// withUpstreamHosts returns no_proxy list with the hosts of the upstream proxies,
+// which are connected directly.
+func withUpstreamHosts(noProxy []string, upstreams *UpstreamPool) []string {
+	list := append([]string{}, noProxy...)
+	for _, u := range upstreams.URLs() {
+		list = append(list, u.Hostname())
+	}
+	return list
+}
+
+func sniffProtocol(c TransproxyConfig, port int) string {
+	for _, p := range c.SniffTLSPorts {
+		if p == port {
+			return SniffTLS
+		}
+	}
+	for _, p := range c.SniffHTTPPorts {
+		if p == port {
+			return SniffHTTP
+		}
+	}
+	return SniffNone
+}
+
+// Start sets up the gateway and starts the proxies. If it returns an error,
+// Stop must be called to stop the started ones and to remove the gateway
+// route and interface.
 func (s *Transproxy) Start() error {
-	for _, proxy := range s.proxies {
+	// The DNS settings left by a crashed run are restored first, even if
+	// the listeners can't be started
+	s.dnsProxy.restoreJournal()
+
+	if s.gateway != nil {
+		if err := s.gateway.Setup(); err != nil {
+			return err
+		}
+	}
+
+	s.upstreams.Start()
+
+	for _, proxy := range s.proxyList() {
 		if err := proxy.Start(); err != nil {
-			log.Fatalf("alert: category='%s[%d]' %s", proxy.GetType(), proxy.GetListenPort(), err.Error())
+			return fmt.Errorf("Can't start %s on port %d: %s", proxy.GetType(), proxy.GetListenPort(), err)
 		}
 	}
 
 	if err := s.dnsProxy.Start(); err != nil {
-		log.Fatalf("alert: category='DNS-Proxy' %s", err.Error())
+		return fmt.Errorf("Can't start DNS proxy: %s", err)
+	}
+
+	if s.admin != nil {
+		if err := s.admin.Start(); err != nil {
+			return fmt.Errorf("Can't start admin API: %s", err)
+		}
+	}
+
+	if s.MetricsListenAddress != "" {
+		addr, err := loopbackAddress(s.MetricsListenAddress)
+		if err == nil {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", s.MetricsHandler())
+			s.metrics, err = listenHTTP("Metrics", addr, mux)
+		}
+		if err != nil {
+			return fmt.Errorf("Can't start metrics listener: %s", err)
+		}
 	}
 
 	log.Printf("info: transproxy-light started")
@@ -85,10 +366,246 @@ func (s *Transproxy) Start() error {
 	return nil
 }
 
+// Stop stops the proxies gracefully in the grace period.
 func (s *Transproxy) Stop() {
+	s.lock.Lock()
+	gracePeriod := s.ShutdownGracePeriod
+	s.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	s.StopContext(ctx)
+}
+
+// StopContext stops the DNS proxy, and stops the proxies in parallel until
+// the context is done. It returns after all connections are closed.
+func (s *Transproxy) StopContext(ctx context.Context) error {
+	if s.admin != nil {
+		s.admin.Stop()
+	}
+	if s.metrics != nil {
+		shutdownHTTP("Metrics", s.metrics)
+		s.metrics = nil
+	}
 	s.dnsProxy.Stop()
 
+	proxies := s.proxyList()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(proxies))
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy Proxy) {
+			defer wg.Done()
+			if err := proxy.StopContext(ctx); err != nil {
+				errs <- err
+			}
+		}(proxy)
+	}
+	wg.Wait()
+	close(errs)
+
+	s.upstreams.Stop()
+
+	if s.gateway != nil {
+		s.gateway.Teardown()
+	}
+
+	log.Printf("info: transproxy-light stopped")
+
+	return <-errs
+}
+
+// Connections returns the active connections of all proxies.
+func (s *Transproxy) Connections() []ConnInfo {
+	conns := []ConnInfo{}
+	for _, proxy := range s.proxyList() {
+		if p, ok := proxy.(connectionProxy); ok {
+			conns = append(conns, p.Connections()...)
+		}
+	}
+	return conns
+}
+
+// CloseConnection force closes the connection of the ID.
+// It returns false if it's not found.
+func (s *Transproxy) CloseConnection(id uint64) bool {
+	for _, proxy := range s.proxyList() {
+		if p, ok := proxy.(connectionProxy); ok && p.CloseConnection(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload applies the configuration to the running proxies without dropping
+// established connections and the mapping table. Upstreams, rules, NoProxy,
+// private DNS servers, client ACL, listen ports and ShutdownGracePeriod of
+// Stop are applied, other settings need restart.
+func (s *Transproxy) Reload(c TransproxyConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Validate all before applying
+	c, _, err := applyGateway(c)
+	if err != nil {
+		return err
+	}
+	poolConfig, upstreams, err := newUpstreams(upstreamPoolConfig(c))
+	if err != nil {
+		return err
+	}
+	for _, u := range poolConfig.Upstreams {
+		c.NoProxy = append(c.NoProxy, u.URL.Hostname())
+	}
+	rules, err := NewRules(c.Rules, c.NoProxy)
+	if err != nil {
+		return err
+	}
+	acl, err := NewClientACL(c.AllowClients, c.DenyClients)
+	if err != nil {
+		return err
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+
+	// Start proxies of added ports at last, which might fail. Nothing is
+	// applied if any of them fails.
+	removed := map[string]Proxy{}
 	for _, proxy := range s.proxies {
-		proxy.Stop()
+		removed[proxyKey(proxy.GetType(), proxy.GetListenPort())] = proxy
+	}
+	wanted := []Proxy{}
+	for _, p := range c.ProxyListenPorts {
+		wanted = append(wanted, s.newPassThroughProxy(c, p))
+	}
+	for _, p := range c.HTTPForwardListenPorts {
+		wanted = append(wanted, s.newHTTPForwardProxy(c, p))
+	}
+	proxies := []Proxy{}
+	started := []Proxy{}
+	for _, proxy := range wanted {
+		key := proxyKey(proxy.GetType(), proxy.GetListenPort())
+		if current, ok := removed[key]; ok {
+			proxies = append(proxies, current)
+			delete(removed, key)
+			continue
+		}
+		if err := proxy.Start(); err != nil {
+			for _, p := range started {
+				p.Stop()
+			}
+			return fmt.Errorf("Can't start %s on port %d: %s", proxy.GetType(), proxy.GetListenPort(), err)
+		}
+		proxies = append(proxies, proxy)
+		started = append(started, proxy)
+	}
+
+	if changed := restartSettings(s.TransproxyConfig, c); len(changed) > 0 {
+		log.Printf("warn: Changed settings need restart, they aren't applied to the running listeners: %s", strings.Join(changed, ", "))
+	}
+
+	s.upstreams.update(poolConfig, upstreams)
+	s.rules.Update(rules)
+	s.acl.Update(acl)
+	s.dnsProxy.SetPrivateDNS(c.PrivateDNS)
+	log.Printf("info: NoProxyZone: %s", c.NoProxy)
+
+	for _, proxy := range removed {
+		// Stop listening and let active connections finish by themselves
+		log.Printf("info: category='%s' Removed port %d", proxy.GetType(), proxy.GetListenPort())
+		go proxy.StopContext(context.Background())
+	}
+	s.proxies = proxies
+	s.TransproxyConfig = c
+
+	log.Printf("info: transproxy-light reloaded")
+
+	return nil
+}
+
+// restartSettings returns the names of the settings which are changed but
+// not applied by Reload.
+func restartSettings(old, c TransproxyConfig) []string {
+	changed := []string{}
+	if !equalStrings(old.DNSListenAddresses, c.DNSListenAddresses) {
+		changed = append(changed, "DNSListenAddress")
+	}
+	if old.GatewayInterface != c.GatewayInterface || old.GatewayPool != c.GatewayPool {
+		changed = append(changed, "GatewayInterface and GatewayPool")
+	}
+	if old.ProxyBindAddress != c.ProxyBindAddress {
+		changed = append(changed, "BindAddress")
+	}
+	if !equalInts(old.SniffTLSPorts, c.SniffTLSPorts) || !equalInts(old.SniffHTTPPorts, c.SniffHTTPPorts) {
+		changed = append(changed, "SniffTLSPort and SniffHTTPPort")
+	}
+	if old.HostPolicy != c.HostPolicy {
+		changed = append(changed, "HostPolicy")
+	}
+	if relayConfig(old) != relayConfig(c) {
+		changed = append(changed, "IdleTimeout and MaxConnectionLifetime")
+	}
+	if !equalStrings(old.PublicDNS, c.PublicDNS) {
+		changed = append(changed, "PublicDNS")
+	}
+	if !equalStrings(old.TunnelDNS, c.TunnelDNS) {
+		changed = append(changed, "TunnelDNS")
+	}
+	if old.SyntheticIPv6Prefix != c.SyntheticIPv6Prefix {
+		changed = append(changed, "SyntheticIPv6Prefix")
 	}
+	if old.StartLocalIP != c.StartLocalIP || old.EndLocalIP != c.EndLocalIP {
+		changed = append(changed, "LoopbackAddressRange")
+	}
+	if old.MappingFile != c.MappingFile || old.MappingRetention != c.MappingRetention {
+		changed = append(changed, "MappingFile and MappingRetention")
+	}
+	if old.DNSEnableUDP != c.DNSEnableUDP || old.DNSEnableTCP != c.DNSEnableTCP {
+		changed = append(changed, "DNSEnableUDP and DNSEnableTCP")
+	}
+	if old.ResolvConf != c.ResolvConf || old.DNSJournal != c.DNSJournal {
+		changed = append(changed, "ResolvConf and DNSJournal")
+	}
+	if old.AdminListenAddress != c.AdminListenAddress || old.AdminToken != c.AdminToken {
+		changed = append(changed, "AdminAddress and AdminToken")
+	}
+	if old.MetricsListenAddress != c.MetricsListenAddress {
+		changed = append(changed, "MetricsAddress")
+	}
+	return changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Transproxy) proxyList() []Proxy {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.proxies
+}
+
+func proxyKey(proxyType string, port int) string {
+	return fmt.Sprintf("%s:%d", proxyType, port)
 }
@@ -0,0 +1,539 @@
+package transproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Selection policies of upstream proxies. Upstreams of the lowest priority
+// value are selected first, and unhealthy ones are tried at last.
+const (
+	// PolicyFailover selects upstreams in the configured order.
+	PolicyFailover = "failover"
+
+	// PolicyRoundRobin selects upstreams in weighted round-robin.
+	PolicyRoundRobin = "round-robin"
+
+	// PolicyLowestLatency selects the upstream of the lowest health check latency.
+	PolicyLowestLatency = "lowest-latency"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	healthCheckTimeout         = 10 * time.Second
+
+	// Target requested by CONNECT for health checks by default
+	defaultHealthCheckTarget = "github.com:443"
+
+	// HealthCheckTarget to check only TCP connection to the proxy
+	HealthCheckTCP = "tcp"
+)
+
+type UpstreamConfig struct {
+	Name     string
+	URL      *url.URL
+	Weight   int // for PolicyRoundRobin, 1 if it's 0
+	Priority int
+	TLS      *tls.Config // for https:// URL, Tunnel.TLS of the pool if it's nil
+}
+
+type UpstreamPoolConfig struct {
+	Upstreams           []UpstreamConfig
+	Policy              string
+	HealthCheckInterval time.Duration
+
+	// Target which is requested by CONNECT for health checks, github.com:443
+	// if it's empty. Only TCP connection to the proxy is checked if it's
+	// HealthCheckTCP.
+	HealthCheckTarget string
+
+	Tunnel TunnelConfig
+}
+
+// UpstreamStatus is a snapshot of the upstream state.
+type UpstreamStatus struct {
+	Name      string
+	URL       string
+	Priority  int
+	Weight    int
+	Healthy   bool
+	Latency   time.Duration
+	LastCheck time.Time
+	LastError string
+}
+
+// UpstreamPool is a proxy.Dialer which dials through one of the upstream
+// proxies by the selection policy and fails over to others on errors of
+// the upstream.
+type UpstreamPool struct {
+	UpstreamPoolConfig
+	upstreams []*upstream
+
+	lock    sync.Mutex
+	stop    chan struct{}
+	dialers map[string]proxy.Dialer // dialers of upstreams by URL, cleared by Update
+}
+
+type upstream struct {
+	UpstreamConfig
+	dialer proxy.Dialer
+
+	// guarded by UpstreamPool.lock
+	healthy       bool
+	latency       time.Duration
+	lastCheck     time.Time
+	lastError     error
+	currentWeight int
+}
+
+func NewUpstreamPool(c UpstreamPoolConfig) (*UpstreamPool, error) {
+	c, upstreams, err := newUpstreams(c)
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamPool{
+		UpstreamPoolConfig: c,
+		upstreams:          upstreams,
+	}, nil
+}
+
+func newUpstreams(c UpstreamPoolConfig) (UpstreamPoolConfig, []*upstream, error) {
+	if len(c.Upstreams) == 0 {
+		return c, nil, errors.New("No upstream proxies")
+	}
+	switch c.Policy {
+	case "":
+		c.Policy = PolicyFailover
+	case PolicyFailover, PolicyRoundRobin, PolicyLowestLatency:
+	default:
+		return c, nil, fmt.Errorf("Unknown upstream policy: %s", c.Policy)
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+
+	upstreams := []*upstream{}
+	names := map[string]struct{}{}
+	for i, uc := range c.Upstreams {
+		if uc.URL == nil {
+			return c, nil, fmt.Errorf("No URL of upstream #%d", i+1)
+		}
+		if uc.Name == "" {
+			uc.Name = uc.URL.Host
+		}
+		if _, ok := names[uc.Name]; ok {
+			return c, nil, fmt.Errorf("Duplicated upstream name: %s", uc.Name)
+		}
+		names[uc.Name] = struct{}{}
+		if uc.Weight <= 0 {
+			uc.Weight = 1
+		}
+		tunnel := c.Tunnel
+		if uc.TLS != nil {
+			tunnel.TLS = uc.TLS
+		}
+		dialer, err := newProxyDialer(uc.URL, tunnel)
+		if err != nil {
+			return c, nil, fmt.Errorf("Invalid upstream %s: %s", uc.Name, err)
+		}
+		upstreams = append(upstreams, &upstream{
+			UpstreamConfig: uc,
+			dialer:         dialer,
+			healthy:        true,
+		})
+	}
+	return c, upstreams, nil
+}
+
+// Update replaces the upstreams and the policy. The health of upstreams whose
+// name and URL are not changed is kept. Established tunnels are not affected.
+func (p *UpstreamPool) Update(c UpstreamPoolConfig) error {
+	c, upstreams, err := newUpstreams(c)
+	if err != nil {
+		return err
+	}
+	p.update(c, upstreams)
+	return nil
+}
+
+// update replaces the upstreams by the validated ones, keeping the health
+// of the upstreams which aren't changed.
+func (p *UpstreamPool) update(c UpstreamPoolConfig, upstreams []*upstream) {
+	p.lock.Lock()
+	old := map[string]*upstream{}
+	for _, u := range p.upstreams {
+		old[u.Name] = u
+	}
+	for _, u := range upstreams {
+		if o, ok := old[u.Name]; ok && o.URL.String() == u.URL.String() {
+			u.healthy, u.latency, u.lastCheck, u.lastError = o.healthy, o.latency, o.lastCheck, o.lastError
+		}
+	}
+	restart := p.stop != nil && p.HealthCheckInterval != c.HealthCheckInterval
+	p.UpstreamPoolConfig = c
+	p.upstreams = upstreams
+	p.dialers = nil
+	p.lock.Unlock()
+
+	log.Printf("info: category='Upstream' Updated upstreams: %d, policy: %s", len(upstreams), c.Policy)
+
+	if restart {
+		p.Stop()
+		p.Start()
+	} else {
+		go p.checkAll()
+	}
+}
+
+// Start starts the background health checker.
+func (p *UpstreamPool) Start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		p.checkAll()
+		for {
+			select {
+			case <-ticker.C:
+				p.checkAll()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop, p.HealthCheckInterval)
+}
+
+func (p *UpstreamPool) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// Dial connects to the address through the upstreams in the order of the policy.
+func (p *UpstreamPool) Dial(network, addr string) (net.Conn, error) {
+	var err error
+	for _, u := range p.candidates() {
+		var c net.Conn
+		c, err = u.dialer.Dial(network, addr)
+		if !p.dialed(u, err) {
+			return c, err
+		}
+		log.Printf("warn: category='Upstream' Dial %s through %s failed: %s", addr, u.Name, err)
+	}
+	return nil, err
+}
+
+// dialed records the result of dialing through the upstream. It reports
+// whether the error is caused by the upstream, then the upstream is tried
+// after others until the health checker finds it's up.
+func (p *UpstreamPool) dialed(u *upstream, err error) bool {
+	if err == nil || !upstreamFailed(err) {
+		p.setHealth(u, true, 0, nil)
+		return false
+	}
+	p.setHealth(u, false, 0, err)
+	return true
+}
+
+// upstreamFailed reports whether the dial error is caused by the upstream,
+// so that another upstream might succeed. They are errors of connecting to
+// the proxy and of the handshake, 407 and 5xx responses of the proxy itself.
+// Responses about the target, e.g. 403, 502 and 504, aren't failed over.
+func upstreamFailed(err error) bool {
+	var pe *ProxyError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	code := pe.StatusCode
+	return code == http.StatusProxyAuthRequired ||
+		code >= 500 && code != http.StatusBadGateway && code != http.StatusGatewayTimeout
+}
+
+// healthCheckFailed reports whether the error of the health check means the
+// upstream is down. Unlike upstreamFailed, 502 and 504 are failures since the
+// target is expected to be reachable, e.g. the parent proxy is broken. Other
+// responses, e.g. 403 by the policy of the proxy, mean the upstream works.
+func healthCheckFailed(err error) bool {
+	var pe *ProxyError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	return pe.StatusCode == http.StatusProxyAuthRequired || pe.StatusCode >= 500
+}
+
+// Get returns the dialer of the upstream by the name.
+func (p *UpstreamPool) Get(name string) (proxy.Dialer, bool) {
+	for _, u := range p.list() {
+		if u.Name == name {
+			return u.dialer, true
+		}
+	}
+	return nil, false
+}
+
+// urlDialer returns the dialer through the upstream proxy of the URL, which
+// isn't in the pool. It's created with the tunnel configuration of the pool,
+// and created again after Update.
+func (p *UpstreamPool) urlDialer(rawurl string) (proxy.Dialer, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if pdialer, ok := p.dialers[rawurl]; ok {
+		return pdialer, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	pdialer, err := newProxyDialer(u, p.Tunnel)
+	if err != nil {
+		return nil, err
+	}
+	if p.dialers == nil {
+		p.dialers = make(map[string]proxy.Dialer)
+	}
+	p.dialers[rawurl] = pdialer
+	return pdialer, nil
+}
+
+// URL returns the URL of the upstream by the name.
+func (p *UpstreamPool) URL(name string) (*url.URL, bool) {
+	for _, u := range p.list() {
+		if u.Name == name {
+			return u.URL, true
+		}
+	}
+	return nil, false
+}
+
+// Select returns the URL of the upstream which is used first by the policy.
+func (p *UpstreamPool) Select() *url.URL {
+	return p.selected().URL
+}
+
+// selected returns the upstream which is used first by the policy.
+func (p *UpstreamPool) selected() *upstream {
+	return p.candidates()[0]
+}
+
+// URLs returns the URLs of all upstreams.
+func (p *UpstreamPool) URLs() []*url.URL {
+	urls := []*url.URL{}
+	for _, u := range p.list() {
+		urls = append(urls, u.URL)
+	}
+	return urls
+}
+
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := []UpstreamStatus{}
+	for _, u := range p.upstreams {
+		s := UpstreamStatus{
+			Name:      u.Name,
+			URL:       RedactURL(u.URL),
+			Priority:  u.Priority,
+			Weight:    u.Weight,
+			Healthy:   u.healthy,
+			Latency:   u.latency,
+			LastCheck: u.lastCheck,
+		}
+		if u.lastError != nil {
+			s.LastError = u.lastError.Error()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// list returns the upstreams, which are replaced by Update.
+func (p *UpstreamPool) list() []*upstream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.upstreams
+}
+
+// candidates returns the upstreams in the order to try.
+func (p *UpstreamPool) candidates() []*upstream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var healthy, unhealthy []*upstream
+	for _, u := range p.upstreams {
+		if u.healthy {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+
+	byPriority := func(list []*upstream) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Priority < list[j].Priority
+		})
+	}
+	byPriority(healthy)
+	byPriority(unhealthy)
+
+	if len(healthy) > 0 {
+		switch p.Policy {
+		case PolicyRoundRobin:
+			p.roundRobin(healthy)
+		case PolicyLowestLatency:
+			sort.SliceStable(healthy, func(i, j int) bool {
+				if healthy[i].Priority != healthy[j].Priority {
+					return healthy[i].Priority < healthy[j].Priority
+				}
+				return healthy[i].latency < healthy[j].latency
+			})
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// roundRobin moves the next upstream of the best priority to the head
+// by smooth weighted round-robin.
+func (p *UpstreamPool) roundRobin(list []*upstream) {
+	n := 1
+	for n < len(list) && list[n].Priority == list[0].Priority {
+		n++
+	}
+
+	total := 0
+	best := 0
+	for i := 0; i < n; i++ {
+		list[i].currentWeight += list[i].Weight
+		total += list[i].Weight
+		if list[i].currentWeight > list[best].currentWeight {
+			best = i
+		}
+	}
+	list[best].currentWeight -= total
+
+	selected := list[best]
+	copy(list[1:best+1], list[:best])
+	list[0] = selected
+}
+
+func (p *UpstreamPool) checkAll() {
+	p.lock.Lock()
+	upstreams := p.upstreams
+	target := p.HealthCheckTarget
+	p.lock.Unlock()
+	if target == "" {
+		target = defaultHealthCheckTarget
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			p.check(u, target)
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (p *UpstreamPool) check(u *upstream, target string) {
+	start := time.Now()
+
+	var c net.Conn
+	var err error
+	if target != HealthCheckTCP {
+		c, err = dialTimeout(u.dialer, "tcp", target, healthCheckTimeout)
+	} else {
+		c, err = net.DialTimeout("tcp", proxyAddr(u.URL), healthCheckTimeout)
+	}
+	if err == nil {
+		c.Close()
+	}
+
+	healthy := err == nil || !healthCheckFailed(err)
+	latency := time.Since(start)
+	p.setHealth(u, healthy, latency, err)
+
+	log.Printf("debug: category='Upstream' Health check of %s: healthy=%v latency=%s error=%v", u.Name, healthy, latency, err)
+}
+
+func (p *UpstreamPool) setHealth(u *upstream, healthy bool, latency time.Duration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if u.healthy != healthy {
+		if healthy {
+			log.Printf("info: category='Upstream' Upstream %s is up", u.Name)
+		} else {
+			log.Printf("warn: category='Upstream' Upstream %s is down: %s", u.Name, err)
+		}
+	}
+	u.healthy = healthy
+	u.lastError = err
+	if latency > 0 {
+		u.latency = latency
+		u.lastCheck = time.Now()
+	}
+}
+
+// dialTimeout dials by the dialer, and gives up waiting after the timeout.
+func dialTimeout(d proxy.Dialer, network, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(network, addr)
+		ch <- result{c, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.c, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-ch; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, fmt.Errorf("Dial %s timed out", addr)
+	}
+}
+
+// RedactURL returns the URL without the password.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	uu := *u
+	uu.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return uu.String()
+}
@@ -0,0 +1,320 @@
+package transproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailed(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), true},
+		{&ProxyError{StatusCode: 407, Err: errAuthRejected}, true},
+		{&ProxyError{StatusCode: 500}, true},
+		{&ProxyError{StatusCode: 503}, true},
+		{fmt.Errorf("wrapped: %w", &ProxyError{StatusCode: 503}), true},
+		{&ProxyError{StatusCode: 403}, false},
+		{&ProxyError{StatusCode: 502}, false},
+		{&ProxyError{StatusCode: 504}, false},
+	}
+	for _, tt := range tests {
+		if got := upstreamFailed(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+type stubDialer struct {
+	err   error
+	dials int
+	addrs []string
+}
+
+func (d *stubDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dials++
+	d.addrs = append(d.addrs, addr)
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, s := net.Pipe()
+	s.Close()
+	return c, nil
+}
+
+type stubUpstream struct {
+	name     string
+	priority int
+	weight   int
+	healthy  bool
+	latency  time.Duration
+}
+
+// newStubPool returns the pool of the upstreams whose dialers are stubs.
+func newStubPool(t *testing.T, policy string, stubs []stubUpstream) (*UpstreamPool, map[string]*stubDialer) {
+	configs := []UpstreamConfig{}
+	for _, s := range stubs {
+		configs = append(configs, UpstreamConfig{
+			Name:     s.name,
+			URL:      &url.URL{Scheme: "http", Host: s.name + ".example.org:3128"},
+			Priority: s.priority,
+			Weight:   s.weight,
+		})
+	}
+	p, err := NewUpstreamPool(UpstreamPoolConfig{Upstreams: configs, Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialers := map[string]*stubDialer{}
+	for i, u := range p.upstreams {
+		d := &stubDialer{}
+		dialers[u.Name] = d
+		u.dialer = d
+		u.healthy = stubs[i].healthy
+		u.latency = stubs[i].latency
+	}
+	return p, dialers
+}
+
+func names(list []*upstream) []string {
+	names := []string{}
+	for _, u := range list {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+func TestUpstreamPoolCandidates(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		upstreams []stubUpstream
+		want      []string
+	}{
+		{"failover in the configured order", PolicyFailover, []stubUpstream{
+			{name: "a", healthy: true}, {name: "b", healthy: true}, {name: "c", healthy: true},
+		}, []string{"a", "b", "c"}},
+		{"failover by priority", PolicyFailover, []stubUpstream{
+			{name: "a", priority: 2, healthy: true}, {name: "b", priority: 1, healthy: true}, {name: "c", priority: 1, healthy: true},
+		}, []string{"b", "c", "a"}},
+		{"unhealthy at last", PolicyFailover, []stubUpstream{
+			{name: "a", healthy: false}, {name: "b", priority: 1, healthy: true}, {name: "c", priority: 2, healthy: true},
+		}, []string{"b", "c", "a"}},
+		{"all unhealthy by priority", PolicyFailover, []stubUpstream{
+			{name: "a", priority: 1}, {name: "b", priority: 0}, {name: "c", priority: 1},
+		}, []string{"b", "a", "c"}},
+		{"lowest latency", PolicyLowestLatency, []stubUpstream{
+			{name: "a", latency: 30 * time.Millisecond, healthy: true},
+			{name: "b", latency: 10 * time.Millisecond, healthy: true},
+			{name: "c", latency: 20 * time.Millisecond, healthy: true},
+		}, []string{"b", "c", "a"}},
+		{"lowest latency by priority", PolicyLowestLatency, []stubUpstream{
+			{name: "a", priority: 1, latency: 10 * time.Millisecond, healthy: true},
+			{name: "b", latency: 30 * time.Millisecond, healthy: true},
+			{name: "c", latency: 20 * time.Millisecond, healthy: true},
+		}, []string{"c", "b", "a"}},
+		{"lowest latency of healthy", PolicyLowestLatency, []stubUpstream{
+			{name: "a", latency: 10 * time.Millisecond},
+			{name: "b", latency: 30 * time.Millisecond, healthy: true},
+		}, []string{"b", "a"}},
+		{"all unhealthy round-robin", PolicyRoundRobin, []stubUpstream{
+			{name: "a", priority: 1}, {name: "b"},
+		}, []string{"b", "a"}},
+	}
+	for _, tt := range tests {
+		p, _ := newStubPool(t, tt.policy, tt.upstreams)
+		if got := names(p.candidates()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []stubUpstream
+		want      []string
+	}{
+		{"equal weights", []stubUpstream{
+			{name: "a", healthy: true}, {name: "b", healthy: true},
+		}, []string{"a", "b", "a", "b"}},
+		{"weighted", []stubUpstream{
+			{name: "a", weight: 2, healthy: true}, {name: "b", weight: 1, healthy: true},
+		}, []string{"a", "b", "a", "a", "b", "a"}},
+		{"best priority only", []stubUpstream{
+			{name: "a", healthy: true}, {name: "b", priority: 1, weight: 10, healthy: true}, {name: "c", healthy: true},
+		}, []string{"a", "c", "a", "c"}},
+		{"healthy only", []stubUpstream{
+			{name: "a", healthy: true}, {name: "b"}, {name: "c", healthy: true},
+		}, []string{"a", "c", "a", "c"}},
+	}
+	for _, tt := range tests {
+		p, _ := newStubPool(t, PolicyRoundRobin, tt.upstreams)
+		got := []string{}
+		for range tt.want {
+			got = append(got, p.selected().Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamPoolDial(t *testing.T) {
+	refused := errors.New("connection refused")
+	forbidden := &ProxyError{StatusCode: 403}
+	unavailable := &ProxyError{StatusCode: 503}
+
+	tests := []struct {
+		name    string
+		errs    []error // of a, b
+		wantErr error
+		dials   []int
+		healthy []bool
+	}{
+		{"first", []error{nil, nil}, nil, []int{1, 0}, []bool{true, true}},
+		{"failover on refused", []error{refused, nil}, nil, []int{1, 1}, []bool{false, true}},
+		{"failover on 503", []error{unavailable, nil}, nil, []int{1, 1}, []bool{false, true}},
+		{"no failover on 403", []error{forbidden, nil}, forbidden, []int{1, 0}, []bool{true, true}},
+		{"all failed", []error{refused, unavailable}, unavailable, []int{1, 1}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		p, dialers := newStubPool(t, PolicyFailover, []stubUpstream{
+			{name: "a", healthy: true}, {name: "b", healthy: true},
+		})
+		dialers["a"].err, dialers["b"].err = tt.errs[0], tt.errs[1]
+
+		c, err := p.Dial("tcp", "www.example.com:443")
+		if err != tt.wantErr {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if c != nil {
+			c.Close()
+		}
+		for i, u := range p.upstreams {
+			if d := dialers[u.Name].dials; d != tt.dials[i] {
+				t.Errorf("%s: %s dialed %d times, want %d", tt.name, u.Name, d, tt.dials[i])
+			}
+			if u.healthy != tt.healthy[i] {
+				t.Errorf("%s: %s healthy %v, want %v", tt.name, u.Name, u.healthy, tt.healthy[i])
+			}
+		}
+	}
+
+	// The failed upstream is tried after the others by the next dial
+	p, dialers := newStubPool(t, PolicyFailover, []stubUpstream{
+		{name: "a", healthy: true}, {name: "b", healthy: true},
+	})
+	dialers["a"].err = refused
+	p.Dial("tcp", "www.example.com:443")
+	p.Dial("tcp", "www.example.com:443")
+	if dialers["a"].dials != 1 || dialers["b"].dials != 2 {
+		t.Errorf("dialed a %d times and b %d times, want 1 and 2", dialers["a"].dials, dialers["b"].dials)
+	}
+}
+
+func TestUpstreamPoolCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		healthy bool
+		err     error
+		want    bool
+	}{
+		{"stays up", true, nil, true},
+		{"goes up", false, nil, true},
+		{"goes down by refused", true, errors.New("connection refused"), false},
+		{"goes down by 407", true, &ProxyError{StatusCode: 407, Err: errAuthRejected}, false},
+		{"goes down by 503", true, &ProxyError{StatusCode: 503}, false},
+		{"stays down", false, errors.New("connection refused"), false},
+		{"up by 403 of the target", false, &ProxyError{StatusCode: 403}, true},
+		{"goes down by 502", true, &ProxyError{StatusCode: 502}, false},
+		{"goes down by 504", true, &ProxyError{StatusCode: 504}, false},
+	}
+	for _, tt := range tests {
+		p, dialers := newStubPool(t, PolicyFailover, []stubUpstream{{name: "a", healthy: tt.healthy}})
+		dialers["a"].err = tt.err
+		u := p.upstreams[0]
+
+		p.check(u, "www.example.com:443")
+		s := p.Status()[0]
+		if s.Healthy != tt.want {
+			t.Errorf("%s: healthy %v, want %v", tt.name, s.Healthy, tt.want)
+		}
+		if s.LastCheck.IsZero() || s.Latency <= 0 {
+			t.Errorf("%s: not recorded: %+v", tt.name, s)
+		}
+		if (tt.err == nil) != (s.LastError == "") {
+			t.Errorf("%s: last error %q, want %v", tt.name, s.LastError, tt.err)
+		}
+	}
+}
+
+func TestUpstreamPoolCheckTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	p, _ := newStubPool(t, PolicyFailover, []stubUpstream{{name: "a"}})
+	u := p.upstreams[0]
+	u.URL = &url.URL{Scheme: "http", Host: addr}
+
+	p.check(u, HealthCheckTCP)
+	if !p.Status()[0].Healthy {
+		t.Errorf("down while listening: %s", p.Status()[0].LastError)
+	}
+
+	l.Close()
+	p.check(u, HealthCheckTCP)
+	if p.Status()[0].Healthy {
+		t.Error("up after closed")
+	}
+}
+
+func TestUpstreamPoolCheckDefault(t *testing.T) {
+	p, dialers := newStubPool(t, PolicyFailover, []stubUpstream{{name: "a", healthy: true}})
+	dialers["a"].err = &ProxyError{StatusCode: 502}
+
+	// CONNECT to the default target, and a broken parent proxy is down
+	p.checkAll()
+	if want := []string{defaultHealthCheckTarget}; !reflect.DeepEqual(dialers["a"].addrs, want) {
+		t.Errorf("targets %v, want %v", dialers["a"].addrs, want)
+	}
+	if p.Status()[0].Healthy {
+		t.Error("up by 502 of the health check")
+	}
+}
+
+func TestUpstreamPoolURLDialer(t *testing.T) {
+	p, _ := newStubPool(t, PolicyFailover, []stubUpstream{{name: "a", healthy: true}})
+	const rawurl = "http://proxy.example.org:3128"
+
+	d1, err := p.urlDialer(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := p.urlDialer(rawurl); d != d1 {
+		t.Error("not cached")
+	}
+
+	// The dialer is created again with the new tunnel configuration
+	c := p.UpstreamPoolConfig
+	c.Tunnel.HandshakeTimeout = time.Second
+	if err := p.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	d2, _ := p.urlDialer(rawurl)
+	if d2 == d1 {
+		t.Error("cached after Update")
+	}
+	if hd, ok := d2.(*httpDialer); !ok || hd.handshakeTimeout != time.Second {
+		t.Errorf("dialer %#v, want the handshake timeout of 1s", d2)
+	}
+}